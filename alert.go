@@ -0,0 +1,83 @@
+package noisesocket
+
+import (
+	"strconv"
+)
+
+// Alert tells the peer why the connection failed without revealing internal error text.
+// Servers send an alert when the handshake fails, either side sends one when a transport
+// packet cannot be read. Set Config.DisableAlerts to close the connection silently instead.
+type Alert uint8
+
+const (
+	AlertInternalError      Alert = iota + 1 // the sender failed for a reason unrelated to the peer
+	AlertNoSupportedSuite                    // none of the offered protocols is acceptable
+	AlertVerificationFailed                  // the peer's static key or fields were rejected
+	AlertBadMessage                          // a message could not be parsed
+	AlertDecryptionFailed                    // a message could not be decrypted
+	AlertPacketTooLarge                      // a packet exceeded the announced maximum packet size
+)
+
+// alertIndex in place of the message index marks a plaintext alert packet of the responder:
+// the index, then the alert. Initiators offer at most 255 protocols, so it is never a valid index
+const alertIndex = 0xFF
+
+var alertText = map[Alert]string{
+	AlertInternalError:      "internal error",
+	AlertNoSupportedSuite:   "no supported suite",
+	AlertVerificationFailed: "verification failed",
+	AlertBadMessage:         "bad message",
+	AlertDecryptionFailed:   "decryption failed",
+	AlertPacketTooLarge:     "packet too large",
+}
+
+func (a Alert) String() string {
+	if s, ok := alertText[a]; ok {
+		return s
+	}
+	return "alert(" + strconv.Itoa(int(a)) + ")"
+}
+
+// AlertError is returned when the peer sent an alert.
+// Alerts received before the transport keys are set up are not authenticated.
+type AlertError struct {
+	Alert Alert
+}
+
+func (e *AlertError) Error() string {
+	return "noisesocket: remote error: " + e.Alert.String()
+}
+
+// localError is a local error together with the alert it is reported to the peer with
+type localError struct {
+	alert Alert
+	err   error
+}
+
+func (e *localError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the original error, see errors.Cause
+func (e *localError) Cause() error {
+	return e.err
+}
+
+// withAlert ties err to alert, nil stays nil
+func withAlert(alert Alert, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*localError); ok {
+		return err
+	}
+	return &localError{alert: alert, err: err}
+}
+
+// alertFor returns the alert err is reported with
+func alertFor(err error) Alert {
+	if e, ok := err.(*localError); ok {
+		return e.alert
+	}
+	return AlertInternalError
+}
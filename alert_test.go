@@ -0,0 +1,130 @@
+package noisesocket
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlerts(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	errRejected := errors.New("rejected")
+	reject := func(publicKey []byte, fields []*Field) error {
+		if publicKey == nil {
+			return nil
+		}
+		return errRejected
+	}
+
+	// the server fails before it has transport keys and answers with a plaintext alert
+	client, server := connPair(
+		&Config{StaticKey: ki, CipherSuites: []string{"25519_ChaChaPoly_BLAKE2b"}},
+		&Config{StaticKey: ks, CipherSuites: []string{"25519_AESGCM_SHA256"}},
+	)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Handshake()
+	}()
+	assert.Equal(t, &AlertError{Alert: AlertNoSupportedSuite}, client.Handshake())
+	assert.Equal(t, errNoSupportedProtocols, <-errs)
+	client.Close()
+	server.Close()
+
+	// IK is verified in the first message
+	client, server = connPair(&Config{StaticKey: ki, PeerKey: ks.Public}, &Config{StaticKey: ks, VerifyCallback: reject})
+	go func() {
+		errs <- server.Handshake()
+	}()
+	assert.Equal(t, &AlertError{Alert: AlertVerificationFailed}, client.Handshake())
+	assert.Equal(t, errRejected, <-errs)
+	client.Close()
+	server.Close()
+
+	// XX is verified in the last message, the client reads an encrypted alert
+	client, server = connPair(&Config{StaticKey: ki}, &Config{StaticKey: ks, VerifyCallback: reject})
+	go func() {
+		errs <- server.Handshake()
+	}()
+	assert.NoError(t, client.Handshake())
+	assert.Equal(t, errRejected, <-errs)
+	_, err := client.Read(make([]byte, 1))
+	assert.Equal(t, &AlertError{Alert: AlertVerificationFailed}, err)
+	client.Close()
+	server.Close()
+
+	// a wrong PSK fails the last XXpsk3 message, the server has no transport keys for its alert
+	psk := make([]byte, 32)
+	rand.Read(psk)
+	lookup := func([]byte) ([]byte, error) { return make([]byte, 32), nil }
+	client, server = connPair(&Config{StaticKey: ki, PSK: psk, PSKIdentity: []byte("device-1")}, &Config{StaticKey: ks, PSKLookup: lookup})
+	go func() {
+		errs <- server.Handshake()
+	}()
+	assert.NoError(t, client.Handshake())
+	assert.Error(t, <-errs)
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, &AlertError{Alert: AlertDecryptionFailed}, err)
+	client.Close()
+	server.Close()
+
+	// hardened servers just close the connection
+	client, server = connPair(&Config{StaticKey: ki, PeerKey: ks.Public}, &Config{StaticKey: ks, VerifyCallback: reject, DisableAlerts: true})
+	go func(server *Conn) {
+		errs <- server.Handshake()
+		server.Close()
+	}(server)
+	err = client.Handshake()
+	assert.Error(t, err)
+	_, isAlert := err.(*AlertError)
+	assert.False(t, isAlert)
+	assert.Equal(t, errRejected, <-errs)
+	client.Close()
+
+	// a forged transport packet
+	client, server = connPair(&Config{StaticKey: ki}, &Config{StaticKey: ks})
+	go func() {
+		errs <- server.Handshake()
+	}()
+	assert.NoError(t, client.Handshake())
+	assert.NoError(t, <-errs)
+
+	forged := make([]byte, 34)
+	rand.Read(forged)
+	forged[0], forged[1] = 0, 32
+	_, err = client.conn.Write(forged)
+	assert.NoError(t, err)
+
+	_, err = server.Read(make([]byte, 1))
+	assert.Error(t, err)
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, &AlertError{Alert: AlertDecryptionFailed}, err)
+	client.Close()
+	server.Close()
+
+	// a plaintext alert injected after the handshake is not believed
+	client, server = connPair(&Config{StaticKey: ki}, &Config{StaticKey: ks})
+	go func() {
+		errs <- server.Handshake()
+	}()
+	assert.NoError(t, client.Handshake())
+	assert.NoError(t, <-errs)
+
+	_, err = client.conn.Write([]byte{0, 2, alertIndex, byte(AlertVerificationFailed)})
+	assert.NoError(t, err)
+
+	_, err = server.Read(make([]byte, 1))
+	assert.Error(t, err)
+	_, isAlert = err.(*AlertError)
+	assert.False(t, isAlert)
+	client.Close()
+	server.Close()
+
+	assert.Equal(t, "noisesocket: remote error: bad message", (&AlertError{Alert: AlertBadMessage}).Error())
+	assert.Equal(t, "alert(200)", Alert(200).String())
+}
@@ -0,0 +1,268 @@
+package noisesocket
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+// DefaultPadding is the padding block size used when Config.Padding is zero.
+const DefaultPadding = 128
+
+// A Config structure is used to configure a NoiseSocket client or server.
+// After one has been passed to a NoiseSocket function it must not be
+// modified. A Config may be reused; the noisesocket package will also not
+// modify it.
+type Config struct {
+	// StaticKey is the local static keypair. It is used with the DH
+	// functions of its size, Curve25519 for 32 byte keys, Curve448 for 56.
+	StaticKey noise.DHKey
+
+	// StaticKeys holds static keypairs by DH function name ("25519", "448")
+	// and takes precedence over StaticKey. Servers answer with the key of the
+	// DH function they select, clients offer the suites they have keys for.
+	StaticKeys map[string]noise.DHKey
+
+	// PeerKey is the remote static public key known in advance.
+	// Clients use it to offer IK in addition to XX. A server that cannot read the IK
+	// offer answers with XX or XXfallback, which fail unless the server presents PeerKey
+	// after all or VerifyCallback accepts the key it presents instead.
+	PeerKey []byte
+
+	// Anonymous, if set, makes clients keep StaticKey to themselves.
+	// They offer NN, and NK if PeerKey is set, instead of XX and IK.
+	Anonymous bool
+
+	// KnownToServer tells clients that the server has their StaticKey
+	// pre-provisioned. With PeerKey set, KK is offered as well.
+	KnownToServer bool
+
+	// ClientKeys lists pre-provisioned client static keys.
+	// Servers accept KK handshakes only from these clients.
+	ClientKeys [][]byte
+
+	// PSK, if set, is a 32 byte pre-shared key mixed into the handshake.
+	// Clients with a PSK offer only psk patterns: XXpsk3, IKpsk2 if PeerKey
+	// is set, or NNpsk0 if Anonymous is set.
+	PSK []byte
+
+	// PSKIdentity is sent by clients in front of every psk handshake message
+	// so that the server can find the PSK. It is not encrypted.
+	PSKIdentity []byte
+
+	// PSKLookup returns the pre-shared key for a client's PSKIdentity.
+	// Servers without PSKLookup do not accept psk patterns.
+	PSKLookup PSKLookupFunc
+
+	// Registry holds the protocols to offer or accept.
+	// If nil, the built-in protocols are used.
+	Registry *Registry
+
+	// Patterns, if not empty, restricts the registry to these patterns,
+	// given by full name such as "XX" or "IKpsk2". Clients offer and
+	// servers prefer them in the order given.
+	Patterns []string
+
+	// CipherSuites, if not empty, restricts the registry to these DH, cipher
+	// and hash combinations, such as "25519_AESGCM_SHA256". Within a pattern,
+	// clients offer and servers prefer them in the order given.
+	// Clients offer the hybrid suites of the default registry only if they are named here.
+	CipherSuites []string
+
+	// Payload contains fields sent to the peer inside the handshake.
+	Payload []*Field
+
+	// VerifyCallback, if not nil, is called with the peer static key and
+	// handshake payload fields. Returning an error aborts the handshake.
+	VerifyCallback VerifyCallbackFunc
+
+	// SuiteSelector is used by servers to choose one of the offered protocols.
+	// If nil, ServerPreference is used.
+	SuiteSelector SuiteSelector
+
+	// MaxPacketSize, if not zero, is announced to the peer as the biggest
+	// packet this side is willing to process. Larger transport packets are
+	// rejected with a *PacketSizeError. Packets sent follow the peer's limit.
+	MaxPacketSize uint16
+
+	// Padding is the block size transport packets are padded to.
+	// If zero, DefaultPadding is used.
+	Padding uint16
+
+	// PaddingPolicy, if not nil, decides the padding of transport packets
+	// instead of Padding. See Conn.SetPaddingPolicy.
+	PaddingPolicy PaddingPolicy
+
+	// CoverTraffic, if not nil, makes the connection send packets at a constant rate.
+	CoverTraffic *CoverTraffic
+
+	// KeepAlive, if not zero, is the interval at which the connection pings the peer,
+	// see Conn.RTT. The handshake fails if it is negative.
+	KeepAlive time.Duration
+
+	// IdleTimeout, if not zero, closes the connection once a Read or ReadMessage has
+	// waited that long without anything arriving from the peer. Read then returns
+	// ErrPeerTimeout. Peers that may be quiet longer need a shorter KeepAlive.
+	// The handshake fails if it is negative or 1ns.
+	//
+	// Packets, pongs included, are only read while the application is in Read or
+	// ReadMessage. The idle clock only runs then, so a connection that is only written
+	// is never dropped, and the RTT advances and pings of the peer are answered only
+	// then, so an application using keepalives must keep reading.
+	IdleTimeout time.Duration
+
+	// HandshakeTimeout, if not zero, limits the time a handshake may take.
+	// A peer that stalls longer than that gets its connection closed.
+	HandshakeTimeout time.Duration
+
+	// RekeyAfterBytes and RekeyAfterPackets, if not zero, rotate the outbound key
+	// once it has encrypted that many bytes or packets. See Conn.Rekey.
+	RekeyAfterBytes   uint64
+	RekeyAfterPackets uint64
+
+	// DisableAlerts stops the connection from telling the peer why it failed,
+	// the connection is just closed. See Alert.
+	DisableAlerts bool
+
+	// FieldHandlers process the fields the peer sends with Conn.WriteField, by type.
+	// See Conn.HandleField.
+	FieldHandlers map[uint16]FieldHandler
+
+	// MaxMessageSize limits the messages of Conn.WriteMessage and Conn.ReadMessage.
+	// If zero, DefaultMaxMessageSize is used. Unread messages may take up to 4 times
+	// as much, a peer sending more fails the connection.
+	MaxMessageSize int
+}
+
+// fieldHandlers returns a copy of FieldHandlers, so that Conn.HandleField does not change c
+func (c *Config) fieldHandlers() map[uint16]FieldHandler {
+	if len(c.FieldHandlers) == 0 {
+		return nil
+	}
+	handlers := make(map[uint16]FieldHandler, len(c.FieldHandlers))
+	for msgType, handler := range c.FieldHandlers {
+		handlers[msgType] = handler
+	}
+	return handlers
+}
+
+// coverTraffic returns a copy of CoverTraffic, nil if it is off
+func (c *Config) coverTraffic() *CoverTraffic {
+	if c.CoverTraffic == nil || c.CoverTraffic.Bandwidth <= 0 {
+		return nil
+	}
+	cover := *c.CoverTraffic
+	return &cover
+}
+
+func (c *Config) registry() *Registry {
+	r := c.Registry
+	if r == nil {
+		r = defaultRegistry
+	}
+	if len(c.Patterns) > 0 || len(c.CipherSuites) > 0 {
+		r = r.restrict(c.Patterns, c.CipherSuites)
+	}
+	return r
+}
+
+func (c *Config) paddingPolicy() PaddingPolicy {
+	if c.PaddingPolicy != nil {
+		return c.PaddingPolicy
+	}
+	if c.Padding == 0 {
+		return BlockPadding(DefaultPadding)
+	}
+	return BlockPadding(int(c.Padding))
+}
+
+// Client returns a new NoiseSocket client side connection
+// using conn as the underlying transport.
+// The config cannot be nil.
+func Client(conn io.ReadWriteCloser, config *Config) *Conn {
+	registry := config.registry()
+	keys := registry.staticKeys(config.StaticKey, config.StaticKeys)
+	if config.Anonymous {
+		keys = nil
+	}
+	return &Conn{
+		conn:              wrapConn(conn),
+		registry:          registry,
+		staticKeys:        keys,
+		PeerKey:           config.PeerKey,
+		isClient:          true,
+		knownToServer:     config.KnownToServer,
+		psk:               config.PSK,
+		pskIdentity:       config.PSKIdentity,
+		paddingPolicy:     config.paddingPolicy(),
+		payload:           config.Payload,
+		verifyCallback:    config.VerifyCallback,
+		handshakeTimeout:  config.HandshakeTimeout,
+		rekeyAfterBytes:   config.RekeyAfterBytes,
+		rekeyAfterPackets: config.RekeyAfterPackets,
+		disableAlerts:     config.DisableAlerts,
+		fieldHandlers:     config.fieldHandlers(),
+		maxMessage:        config.MaxMessageSize,
+		cover:             config.coverTraffic(),
+		keepAlive:         config.KeepAlive,
+		idleTimeout:       config.IdleTimeout,
+		maxRecv:           config.MaxPacketSize,
+	}
+}
+
+// Server returns a new NoiseSocket server side connection
+// using conn as the underlying transport.
+// The config cannot be nil.
+func Server(conn io.ReadWriteCloser, config *Config) *Conn {
+	registry := config.registry()
+	return &Conn{
+		conn:              wrapConn(conn),
+		registry:          registry,
+		staticKeys:        registry.staticKeys(config.StaticKey, config.StaticKeys),
+		clientKeys:        config.ClientKeys,
+		pskLookup:         config.PSKLookup,
+		paddingPolicy:     config.paddingPolicy(),
+		payload:           config.Payload,
+		verifyCallback:    config.VerifyCallback,
+		handshakeTimeout:  config.HandshakeTimeout,
+		suiteSelector:     config.SuiteSelector,
+		rekeyAfterBytes:   config.RekeyAfterBytes,
+		rekeyAfterPackets: config.RekeyAfterPackets,
+		disableAlerts:     config.DisableAlerts,
+		fieldHandlers:     config.fieldHandlers(),
+		maxMessage:        config.MaxMessageSize,
+		cover:             config.coverTraffic(),
+		keepAlive:         config.KeepAlive,
+		idleTimeout:       config.IdleTimeout,
+		maxRecv:           config.MaxPacketSize,
+	}
+}
+
+// wrapConn returns conn itself if it is a net.Conn,
+// otherwise it adapts the io.ReadWriteCloser to net.Conn.
+func wrapConn(conn io.ReadWriteCloser) net.Conn {
+	if c, ok := conn.(net.Conn); ok {
+		return c
+	}
+	return &rwcConn{conn}
+}
+
+// rwcConn is a net.Conn over a plain io.ReadWriteCloser such as a pipe.
+// It has no addresses and does not support deadlines.
+type rwcConn struct {
+	io.ReadWriteCloser
+}
+
+type rwcAddr struct{}
+
+func (rwcAddr) Network() string { return "rwc" }
+func (rwcAddr) String() string  { return "rwc" }
+
+func (c *rwcConn) LocalAddr() net.Addr  { return rwcAddr{} }
+func (c *rwcConn) RemoteAddr() net.Addr { return rwcAddr{} }
+
+func (c *rwcConn) SetDeadline(t time.Time) error      { return errNoDeadlines }
+func (c *rwcConn) SetReadDeadline(t time.Time) error  { return errNoDeadlines }
+func (c *rwcConn) SetWriteDeadline(t time.Time) error { return errNoDeadlines }
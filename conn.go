@@ -1,7 +1,10 @@
 package noisesocket
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -11,10 +14,6 @@ import (
 
 	"sync/atomic"
 
-	"crypto/tls"
-
-	"encoding/json"
-
 	"github.com/flynn/noise"
 	"github.com/pkg/errors"
 )
@@ -23,26 +22,45 @@ const MaxPayloadSize = math.MaxUint16
 
 type VerifyCallbackFunc func(publicKey []byte, fields []*Field) error
 
-type ConnectionInfo struct {
-	Name          string
-	Index         byte
-	PeerKey       []byte
-	ServerPublic  []byte
-	HandshakeHash []byte
+// ConnectionState records basic NoiseSocket details about the connection.
+type ConnectionState struct {
+	HandshakeComplete bool          // NoiseSocket handshake is complete
+	Protocol          string        // full Noise protocol name, e.g. Noise_XX_25519_AESGCM_SHA256
+	Pattern           string        // handshake pattern, e.g. XX
+	DH                string        // DH function name, e.g. 25519
+	Cipher            string        // cipher function name, e.g. AESGCM
+	Hash              string        // hash function name, e.g. SHA256
+	MessageIndex      byte          // index of the chosen sub-message in the initiator's first packet
+	LocalStatic       []byte        // local static public key
+	PeerStatic        []byte        // remote static public key, nil if the peer did not send one
+	HandshakeHash     []byte        // handshake hash, see Conn.ChannelBinding
+	PeerFields        []*Field      // fields the peer sent in its handshake payloads
+	MaxSendPacketSize uint16        // largest packet payload the peer accepts, 0 means MaxPayloadSize
+	MaxRecvPacketSize uint16        // largest packet payload this side accepts, 0 means MaxPayloadSize
+	PaddingPolicy     PaddingPolicy `json:"-"` // padding policy of transport packets, see Conn.SetPaddingPolicy
+	HandshakeDuration time.Duration // time the handshake took
 }
 
 type Conn struct {
 	conn              net.Conn
 	myKeys            noise.DHKey
+	staticKeys        map[string]noise.DHKey
+	registry          *Registry
 	PeerKey           []byte
 	in, out           halfConn
 	handshakeMutex    sync.Mutex
 	handshakeComplete bool
 	isClient          bool
+	knownToServer     bool
+	clientKeys        [][]byte
+	psk               []byte
+	pskIdentity       []byte
+	pskLookup         PSKLookupFunc
 	handshakeErr      error
 	input             *packet
 	rawInput          *packet
-	padding           uint16
+	paddingMutex      sync.Mutex
+	paddingPolicy     PaddingPolicy
 	payload           []*Field
 	// activeCall is an atomic int32; the low bit is whether Close has
 	// been called. the rest of the bits are the number of goroutines
@@ -54,9 +72,43 @@ type Conn struct {
 	handshakeCond     *sync.Cond
 	verifyCallback    VerifyCallbackFunc
 	channelBinding    []byte
-	connectionInfo    []byte
-	HandshakeStrategy int
-	MaxPacketSize     uint16
+	handshakeConfig   *HandshakeConfig
+	peerFields        []*Field
+	messageIndex      byte
+	handshakeDuration time.Duration
+	handshakeTimeout  time.Duration
+	suiteSelector     SuiteSelector
+	rekeyAfterBytes   uint64
+	rekeyAfterPackets uint64
+	rekeyRequested    int32 // atomic, the peer asked to rotate the outbound key
+	transport         int32 // atomic, 1 once the handshake has set up the transport keys
+	closeNotifySent   bool
+	closeNotifyErr    error
+	deadlineMutex     sync.Mutex
+	writeDeadline     time.Time // set by SetDeadline or SetWriteDeadline, restored after close notify
+	disableAlerts     bool
+	handlersMutex     sync.Mutex
+	fieldHandlers     map[uint16]FieldHandler
+	maxMessage        int
+	fragments         []byte   // the incomplete inbound message
+	messages          [][]byte // complete inbound messages, see ReadMessage
+	queuedMessages    int      // bytes of messages, counting their headers
+	cover             *CoverTraffic
+	coverQueue        chan *coverWrite // writes waiting for the cover traffic schedule
+	coverDone         chan struct{}    // closed once the schedule has stopped
+	coverCapacity     int              // the largest field a packet of the schedule carries
+	keepAlive         time.Duration
+	idleTimeout       time.Duration
+	epoch             time.Time // start of the keepalive clock
+	lastRecv          int64     // atomic, keepalive clock time of the last packet read or the start of a read
+	reading           int32     // atomic, 1 while readPacket waits for the peer
+	srtt              int64     // atomic, smoothed round-trip time
+	peerTimedOut      int32     // atomic, 1 once the idle timeout closed the connection
+	pongMutex         sync.Mutex
+	pong              []byte // the pong to send next, see handlePing
+	pongSending       bool   // a goroutine is sending pongs
+	maxSend           uint16 // announced by the peer
+	maxRecv           uint16 // announced to the peer
 }
 
 // Access to net.Conn methods.
@@ -77,6 +129,9 @@ func (c *Conn) RemoteAddr() net.Addr {
 // A zero value for t means Read and Write will not time out.
 // After a Write has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.writeDeadline = t
 	return c.conn.SetDeadline(t)
 }
 
@@ -90,47 +145,79 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 // A zero value for t means Write will not time out.
 // After a Write has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.writeDeadline = t
 	return c.conn.SetWriteDeadline(t)
 }
 
-func (c *Conn) ConnectionState() tls.ConnectionState {
-
-	data := &struct {
-		PeerPublic    []byte
-		HandshakeHash []byte
-	}{PeerPublic: c.PeerKey,
-		HandshakeHash: c.channelBinding}
+// ConnectionState returns basic NoiseSocket details about the connection.
+func (c *Conn) ConnectionState() ConnectionState {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
 
-	bytes, _ := json.Marshal(data)
-	return tls.ConnectionState{
-		TLSUnique: bytes,
+	state := ConnectionState{
+		HandshakeComplete: c.handshakeComplete,
+		LocalStatic:       c.myKeys.Public,
+		MaxSendPacketSize: c.maxSend,
+		MaxRecvPacketSize: c.maxRecv,
+		PaddingPolicy:     c.padding(),
+	}
+	if !c.handshakeComplete {
+		return state
 	}
+
+	cfg := c.handshakeConfig
+	state.Protocol = string(cfg.Name)
+	state.Pattern = cfg.Pattern.Name
+	state.DH = cfg.DH.DHName()
+	state.Cipher = cfg.Cipher.CipherName()
+	state.Hash = cfg.Hash.HashName()
+	state.MessageIndex = c.messageIndex
+	state.PeerStatic = c.PeerKey
+	state.HandshakeHash = c.channelBinding
+	state.PeerFields = c.peerFields
+	state.HandshakeDuration = c.handshakeDuration
+	return state
 }
 
 func (c *Conn) ChannelBinding() []byte {
 	return c.channelBinding
 }
 
+// PacketSizeError is returned by Read when the peer sent a transport packet larger
+// than Config.MaxPacketSize. The packet is rejected before it is decrypted.
+type PacketSizeError struct {
+	Size int // payload size of the packet
+	Max  int // the limit announced to the peer
+}
+
+func (e *PacketSizeError) Error() string {
+	return fmt.Sprintf("noisesocket: packet of %d bytes exceeds the maximum packet size %d", e.Size, e.Max)
+}
+
 var (
-	errClosed = errors.New("tls: use of closed connection")
+	errClosed          = errors.New("tls: use of closed connection")
+	errNoDeadlines     = errors.New("noisesocket: deadlines are not supported by the underlying connection")
+	errShutdown        = errors.New("noisesocket: protocol is shutdown")
+	errEarlyCloseWrite = errors.New("noisesocket: CloseWrite called before handshake complete")
+	errPeerKeyMismatch = errors.New("noisesocket: server key does not match PeerKey")
+	errFieldTooBig     = errors.New("noisesocket: field is too big for a packet")
+	errReservedField   = errors.New("noisesocket: field type is reserved")
 )
 
 func (c *Conn) Write(b []byte) (int, error) {
-	// interlock with Close below
-	for {
-		x := atomic.LoadInt32(&c.activeCall)
-		if x&1 != 0 {
-			return 0, errClosed
-		}
-		if atomic.CompareAndSwapInt32(&c.activeCall, x, x+2) {
-			defer atomic.AddInt32(&c.activeCall, -2)
-			break
-		}
+	if err := c.beginWrite(); err != nil {
+		return 0, err
 	}
+	defer c.endWrite()
 
 	if err := c.Handshake(); err != nil {
 		return 0, err
 	}
+	if c.cover != nil {
+		return c.queueCover(b, MessageTypeData)
+	}
 
 	c.out.Lock()
 	defer c.out.Unlock()
@@ -146,6 +233,24 @@ func (c *Conn) Write(b []byte) (int, error) {
 	return n, c.out.setErrorLocked(err)
 }
 
+// beginWrite marks a write call in flight for the interlock with Close below.
+// Unless it fails, endWrite must follow
+func (c *Conn) beginWrite() error {
+	for {
+		x := atomic.LoadInt32(&c.activeCall)
+		if x&1 != 0 {
+			return errClosed
+		}
+		if atomic.CompareAndSwapInt32(&c.activeCall, x, x+2) {
+			return nil
+		}
+	}
+}
+
+func (c *Conn) endWrite() {
+	atomic.AddInt32(&c.activeCall, -2)
+}
+
 func (c *Conn) writePacket(data []byte) (int, error) {
 	c.out.Lock()
 	defer c.out.Unlock()
@@ -165,6 +270,15 @@ func (c *Conn) writePacketLocked(data []byte) (int, error) {
 	var n int
 	for len(data) > 0 {
 
+		if c.out.cs != nil {
+			if err := c.rekeyIfNeededLocked(); err != nil {
+				return n, err
+			}
+			if err := c.out.checkNonce(); err != nil {
+				return n, err
+			}
+		}
+
 		m := len(data)
 
 		packet := c.InitializePacket()
@@ -182,8 +296,8 @@ func (c *Conn) writePacketLocked(data []byte) (int, error) {
 			binary.BigEndian.PutUint16(packet.data, uint16(len(data)))
 		}
 
-		if c.out.cs != nil && c.padding != 0 {
-			packet.AddPadding(c.padding, c.MaxPacketSize)
+		if c.out.cs != nil {
+			c.addPaddingLocked(packet)
 		}
 
 		b := c.out.encryptIfNeeded(packet)
@@ -200,20 +314,123 @@ func (c *Conn) writePacketLocked(data []byte) (int, error) {
 	return n, nil
 }
 
+// Rekey rotates the outbound key and asks the peer to rotate its outbound key
+// before its next packet, see noise.CipherState.Rekey.
+// Use Config.RekeyAfterBytes and Config.RekeyAfterPackets to rotate keys automatically.
+func (c *Conn) Rekey() error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	if c.cover != nil {
+		_, err := c.queueCover([]byte{1}, MessageTypeRekey)
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	if err := c.out.err; err != nil {
+		return err
+	}
+	return c.out.setErrorLocked(c.rekeyLocked(true))
+}
+
+// rekeyLocked sends a rekey field and rotates the outbound key.
+// If request is set, the peer rotates its outbound key as well.
+// c.out.Mutex <= L
+func (c *Conn) rekeyLocked(request bool) error {
+	data := []byte{0}
+	if request {
+		data[0] = 1
+	}
+	if err := c.writeFieldLocked(data, MessageTypeRekey); err != nil {
+		return err
+	}
+	c.out.rekey()
+	return nil
+}
+
+// rekeyIfNeededLocked rotates the outbound key if the peer asked for it or a limit is reached.
+// c.out.Mutex <= L
+func (c *Conn) rekeyIfNeededLocked() error {
+	if c.rekeyDueLocked() {
+		return c.rekeyLocked(false)
+	}
+	return nil
+}
+
+// rekeyDueLocked reports whether the outbound key must be rotated now.
+// It clears the request of the peer.
+// c.out.Mutex <= L
+func (c *Conn) rekeyDueLocked() bool {
+	return atomic.CompareAndSwapInt32(&c.rekeyRequested, 1, 0) || c.out.rekeyDue(c.rekeyAfterBytes, c.rekeyAfterPackets)
+}
+
+// writeFieldLocked sends a single field in its own encrypted packet.
+// c.out.Mutex <= L
+func (c *Conn) writeFieldLocked(data []byte, msgType uint16) error {
+	if err := c.out.checkNonce(); err != nil {
+		return err
+	}
+
+	packet := c.InitializePacket()
+	packet.AddField(data, msgType)
+	c.addPaddingLocked(packet)
+
+	b := c.out.encryptIfNeeded(packet)
+	c.out.freeBlock(packet)
+
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// SetPaddingPolicy changes the padding of the packets written from now on.
+// A nil policy is NoPadding.
+func (c *Conn) SetPaddingPolicy(policy PaddingPolicy) {
+	if policy == nil {
+		policy = NoPadding
+	}
+	c.paddingMutex.Lock()
+	c.paddingPolicy = policy
+	c.paddingMutex.Unlock()
+}
+
+func (c *Conn) padding() PaddingPolicy {
+	c.paddingMutex.Lock()
+	defer c.paddingMutex.Unlock()
+	return c.paddingPolicy
+}
+
+// addPaddingLocked pads a transport packet as the padding policy asks
+// c.out.Mutex <= L
+func (c *Conn) addPaddingLocked(block *packet) {
+	if n := block.AddPadding(c.padding(), c.maxSend); n > 0 {
+		atomic.AddUint64(&c.out.padding, uint64(n))
+	}
+}
+
+// Stats returns the packet counters of the connection. Padding divided by bytes
+// is the padding overhead.
+func (c *Conn) Stats() Stats {
+	return Stats{
+		PacketsSent:     atomic.LoadUint64(&c.out.total),
+		PacketsReceived: atomic.LoadUint64(&c.in.total),
+		BytesSent:       atomic.LoadUint64(&c.out.size),
+		BytesReceived:   atomic.LoadUint64(&c.in.size),
+		PaddingSent:     atomic.LoadUint64(&c.out.padding),
+		PaddingReceived: atomic.LoadUint64(&c.in.padding),
+	}
+}
+
 func (c *Conn) maxPayloadSizeForWrite(block *packet) uint16 {
 
-	max := c.MaxPacketSize
+	max := c.maxSend
 	if max == 0 || !c.handshakeComplete {
 		max = MaxPayloadSize
 	}
 
-	//res := max //- uint16(len(block.data))
+	//leave room for the padding field, the policy may change at any time
 	if c.out.cs != nil {
-		if c.padding > 0 {
-			return max - macSize - msgHeaderSize*2
-		} else {
-			return max - macSize - msgHeaderSize
-		}
+		return max - macSize - msgHeaderSize*2
 	}
 	return max
 
@@ -235,15 +452,16 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 	c.in.Lock()
 	defer c.in.Unlock()
 
-	if c.input == nil && c.in.err == nil {
-		if err := c.readPacket(); err != nil {
+	//data read along with an error, such as close notify, is delivered first
+	for c.input == nil {
+		if err := c.in.err; err != nil {
+			return 0, err
+		}
+		if err := c.readPacket(); err != nil && c.input == nil {
 			return 0, err
 		}
 	}
 
-	if err := c.in.err; err != nil {
-		return 0, err
-	}
 	n, err = c.input.Read(b)
 	if c.input.off >= len(c.input.data) {
 		c.in.freeBlock(c.input)
@@ -253,7 +471,7 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 	if ri := c.rawInput; ri != nil &&
 		n != 0 && err == nil &&
 		c.input == nil && len(ri.data) > 0 {
-		if recErr := c.readPacket(); recErr != nil {
+		if recErr := c.readPacket(); recErr != nil && c.input == nil {
 			err = recErr // will be io.EOF on closeNotify
 		}
 	}
@@ -266,8 +484,8 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 }
 
 // readPacket reads the next noise packet from the connection
-// and updates the record layer state.
-// c.in.Mutex <= L; c.input == nil.
+// and updates the record layer state. Its data is added to c.input, which stays nil
+// if there is none. c.in.Mutex <= L.
 func (c *Conn) readPacket() error {
 
 	if c.rawInput == nil {
@@ -275,8 +493,22 @@ func (c *Conn) readPacket() error {
 	}
 	b := c.rawInput
 
+	//the idle clock only runs while a reader waits for the peer,
+	//a connection that is not read cannot tell a silent peer from a live one
+	if c.idleTimeout > 0 && c.in.cs != nil {
+		atomic.StoreInt64(&c.lastRecv, int64(time.Since(c.epoch)))
+		atomic.StoreInt32(&c.reading, 1)
+		defer atomic.StoreInt32(&c.reading, 0)
+	}
+
 	// Read header, payload.
 	if err := b.readFromUntil(c.conn, uint16Size); err != nil {
+		if err == io.EOF && c.in.cs != nil {
+			err = io.ErrUnexpectedEOF //the peer did not send close notify
+		}
+		if atomic.LoadInt32(&c.peerTimedOut) == 1 {
+			err = ErrPeerTimeout
+		}
 		if e, ok := err.(net.Error); !ok || !e.Temporary() {
 			c.in.setErrorLocked(err)
 		}
@@ -285,10 +517,19 @@ func (c *Conn) readPacket() error {
 
 	n := int(binary.BigEndian.Uint16(b.data))
 
+	//the peer has been told our limit by the time it sends transport packets
+	if max := c.maxRecv; c.in.cs != nil && max != 0 && n > int(max) {
+		c.sendAlert(AlertPacketTooLarge)
+		return c.in.setErrorLocked(&PacketSizeError{Size: n, Max: int(max)})
+	}
+
 	if err := b.readFromUntil(c.conn, uint16Size+n); err != nil {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
 		}
+		if atomic.LoadInt32(&c.peerTimedOut) == 1 {
+			err = ErrPeerTimeout
+		}
 		if e, ok := err.(net.Error); !ok || !e.Temporary() {
 			c.in.setErrorLocked(err)
 		}
@@ -297,34 +538,199 @@ func (c *Conn) readPacket() error {
 
 	b, c.rawInput = c.in.splitBlock(b, uint16Size+n)
 
+	if err := c.in.checkNonce(); err != nil {
+		c.in.setErrorLocked(err)
+		return err
+	}
+
+	//a plaintext alert of a server that failed before the transport keys were set up,
+	//encrypted packets are never this short
+	if c.in.cs == nil && n == 2 && b.data[uint16Size] == alertIndex {
+		return c.in.setErrorLocked(&AlertError{Alert: Alert(b.data[uint16Size+1])})
+	}
+
 	payload, err := c.in.decryptIfNeeded(b)
 	if err != nil {
+		//a server that failed on the last handshake message has no transport keys yet,
+		//its alert is in plaintext although ours exist
+		if c.isClient && c.in.seq == 0 && n == 2 && b.data[uint16Size] == alertIndex {
+			return c.in.setErrorLocked(&AlertError{Alert: Alert(b.data[uint16Size+1])})
+		}
+		if c.in.cs != nil {
+			c.sendAlert(AlertDecryptionFailed)
+		}
 		c.in.setErrorLocked(err)
 		return err
 	}
+	if c.idleTimeout > 0 && c.in.cs != nil {
+		atomic.StoreInt64(&c.lastRecv, int64(time.Since(c.epoch)))
+	}
 
 	in := c.in.newBlock()
 	if c.in.cs != nil {
-		messages, err := parseMessageFields(payload)
+		fields, err := parseMessageFields(payload)
 
 		if err != nil {
+			c.sendAlert(AlertBadMessage)
+			c.in.freeBlock(in)
 			c.in.setErrorLocked(err)
 			return err
 		}
 
-		msg := messages[0]
-
-		in.resize(len(msg.Data))
-		copy(in.data, msg.Data)
+		//deliver data in order, skip padding and hand other fields to their handlers
+		for _, f := range fields {
+			switch f.Type {
+			case MessageTypeData:
+				in.data = append(in.data, f.Data...)
+			case MessageTypePadding:
+				atomic.AddUint64(&c.in.padding, uint64(len(f.Data)+msgHeaderSize))
+			default:
+				if handler := c.fieldHandler(f.Type); handler != nil {
+					err = handler(c, f.Data)
+				}
+			}
+			if err != nil {
+				c.in.setErrorLocked(err)
+				break
+			}
+		}
 	} else {
 		in.resize(len(payload))
 		copy(in.data, payload)
 	}
 	c.in.freeBlock(b)
+	if c.in.cs != nil && len(in.data) == 0 {
+		c.in.freeBlock(in)
+		return c.in.err
+	}
+	if c.input != nil { //ReadMessage reads on while data is buffered
+		c.input.data = append(c.input.data, in.data...)
+		c.in.freeBlock(in)
+		return c.in.err
+	}
 	c.input = in
 	return c.in.err
 }
 
+// A FieldHandler processes a non-data field of a transport packet. It runs on the goroutine
+// calling Read and must not call Read itself. data is only valid until the handler returns.
+// An error stops the connection from reading further and is returned by Read.
+type FieldHandler func(c *Conn, data []byte) error
+
+// MinFieldType is the lowest field type applications may send with WriteField,
+// lower types are reserved for NoiseSocket, including the handshake's MessageTypeCustomCert
+// and MessageTypeSignature.
+const MinFieldType = MessageTypeSignature + 1
+
+// recordHandlers process the control fields of the record layer
+var recordHandlers = map[uint16]FieldHandler{
+	MessageTypeRekey:       (*Conn).handleRekey,
+	MessageTypeCloseNotify: (*Conn).handleCloseNotify,
+	MessageTypeAlert:       (*Conn).handleAlert,
+
+	MessageTypeMessageFragment: (*Conn).handleFragment,
+	MessageTypeMessage:         (*Conn).handleMessage,
+
+	MessageTypePing: (*Conn).handlePing,
+	MessageTypePong: (*Conn).handlePong,
+}
+
+// HandleField registers handler for fields of msgType written by the peer with WriteField,
+// replacing any previous one. A nil handler drops the fields, as for unregistered types.
+func (c *Conn) HandleField(msgType uint16, handler FieldHandler) {
+	c.handlersMutex.Lock()
+	defer c.handlersMutex.Unlock()
+
+	if c.fieldHandlers == nil {
+		c.fieldHandlers = make(map[uint16]FieldHandler)
+	}
+	c.fieldHandlers[msgType] = handler
+}
+
+// fieldHandler returns the handler for msgType, nil if there is none
+func (c *Conn) fieldHandler(msgType uint16) FieldHandler {
+	if msgType < MinFieldType {
+		return recordHandlers[msgType]
+	}
+
+	c.handlersMutex.Lock()
+	defer c.handlersMutex.Unlock()
+	return c.fieldHandlers[msgType]
+}
+
+// WriteField sends an application field of msgType, at least MinFieldType, in its own
+// encrypted packet. The peer passes it to the handler registered with HandleField
+// or Config.FieldHandlers, data written before and after it flows through Read as usual.
+func (c *Conn) WriteField(msgType uint16, data []byte) error {
+	if msgType < MinFieldType {
+		return errReservedField
+	}
+	if err := c.beginWrite(); err != nil {
+		return err
+	}
+	defer c.endWrite()
+
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	return c.writeRecordField(msgType, data)
+}
+
+// writeRecordField sends a field in its own encrypted packet, once the handshake is done
+func (c *Conn) writeRecordField(msgType uint16, data []byte) error {
+	if c.cover != nil {
+		_, err := c.queueCover(data, msgType)
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	if err := c.out.err; err != nil {
+		return err
+	}
+	if len(data) > int(c.maxPayloadSizeForWrite(nil)) {
+		return errFieldTooBig
+	}
+	if err := c.rekeyIfNeededLocked(); err != nil {
+		return c.out.setErrorLocked(err)
+	}
+	return c.out.setErrorLocked(c.writeFieldLocked(data, msgType))
+}
+
+// MaxFieldSize returns the largest field WriteField sends in a packet.
+// It is only meaningful once the handshake has completed.
+func (c *Conn) MaxFieldSize() int {
+	c.handshakeMutex.Lock()
+	scheduled := c.cover != nil && c.handshakeComplete
+	c.handshakeMutex.Unlock()
+	if scheduled {
+		return c.coverCapacity
+	}
+	c.out.Lock()
+	defer c.out.Unlock()
+	return int(c.maxPayloadSizeForWrite(nil))
+}
+
+// handleRekey rotates the inbound key, the following packets use the new key
+func (c *Conn) handleRekey(data []byte) error {
+	c.in.rekey()
+	if len(data) > 0 && data[0] == 1 {
+		atomic.StoreInt32(&c.rekeyRequested, 1)
+	}
+	return nil
+}
+
+func (c *Conn) handleCloseNotify(_ []byte) error {
+	return io.EOF
+}
+
+func (c *Conn) handleAlert(data []byte) error {
+	if len(data) != 1 {
+		return errors.New("invalid alert")
+	}
+	return &AlertError{Alert: Alert(data[0])}
+}
+
 // Close closes the connection.
 // Any blocked Read or Write operations will be unblocked and return errors.
 func (c *Conn) Close() error {
@@ -348,14 +754,91 @@ func (c *Conn) Close() error {
 		// waiting on handshakeMutex or the c.out mutex.
 		return c.conn.Close()
 	}
-	return c.conn.Close()
+
+	var alertErr error
+	if atomic.LoadInt32(&c.transport) == 1 {
+		if err := c.closeNotify(); err != nil {
+			alertErr = errors.Wrap(err, "noisesocket: failed to send close notify (but connection was closed anyway)")
+		}
+	}
+
+	if err := c.conn.Close(); err != nil {
+		return err
+	}
+	return alertErr
+}
+
+// CloseWrite shuts down the writing side of the connection. The peer reads io.EOF
+// once it has read everything written before, the reading side stays open.
+// It should only be called once the handshake has completed.
+func (c *Conn) CloseWrite() error {
+	if atomic.LoadInt32(&c.transport) == 0 {
+		return errEarlyCloseWrite
+	}
+	return c.closeNotify()
+}
+
+// sendAlert reports alert to the peer unless alerts are disabled.
+// It is encrypted once the transport keys are set up
+func (c *Conn) sendAlert(alert Alert) error {
+	if c.disableAlerts {
+		return nil
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	if c.out.cs != nil {
+		return c.writeFieldLocked([]byte{byte(alert)}, MessageTypeAlert)
+	}
+	_, err := c.writePacketLocked([]byte{alertIndex, byte(alert)})
+	return err
+}
+
+// closeNotify sends an encrypted close notify once. Writes fail afterwards
+func (c *Conn) closeNotify() error {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if !c.closeNotifySent {
+		// Set a Write Deadline to prevent possibly blocking forever,
+		// later writes such as alerts and pongs get the application's deadline back.
+		c.deadlineMutex.Lock()
+		deadline := time.Now().Add(5 * time.Second)
+		if !c.writeDeadline.IsZero() && c.writeDeadline.Before(deadline) {
+			deadline = c.writeDeadline
+		}
+		c.conn.SetWriteDeadline(deadline)
+		c.closeNotifyErr = c.writeFieldLocked(nil, MessageTypeCloseNotify)
+		c.conn.SetWriteDeadline(c.writeDeadline)
+		c.deadlineMutex.Unlock()
+		c.closeNotifySent = true
+		if c.out.err == nil {
+			c.out.setErrorLocked(errShutdown)
+		}
+	}
+	return c.closeNotifyErr
 }
 
 // Handshake runs the client or server handshake
 // protocol if it has not yet been run.
 // Most uses of this package need not call Handshake
 // explicitly: the first Read or Write will call it automatically.
+//
+// For control over canceling or setting a timeout on a handshake, use
+// HandshakeContext or Config.HandshakeTimeout.
 func (c *Conn) Handshake() error {
+	return c.HandshakeContext(context.Background())
+}
+
+// HandshakeContext runs the client or server handshake
+// protocol if it has not yet been run.
+//
+// The provided Context must be non-nil. If the context is canceled before
+// the handshake is complete, the handshake is interrupted, the underlying
+// connection is closed and the context error is returned. Once the
+// handshake has completed, cancellation of the context will not affect the
+// connection.
+func (c *Conn) HandshakeContext(ctx context.Context) error {
 	// c.handshakeErr and c.handshakeComplete are protected by
 	// c.handshakeMutex. In order to perform a handshake, we need to lock
 	// c.in also and c.handshakeMutex must be locked after c.in.
@@ -405,13 +888,63 @@ func (c *Conn) Handshake() error {
 
 	c.handshakeMutex.Lock()
 
-	if c.isClient {
+	start := time.Now()
+	if c.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.handshakeTimeout)
+		defer cancel()
+	}
+
+	// interrupt the handshake by closing the connection
+	// if ctx is done before the handshake returns
+	var done chan struct{}
+	var interrupted chan error
+	if ctx.Done() != nil {
+		done = make(chan struct{})
+		interrupted = make(chan error, 1)
+		go func() {
+			select {
+			case <-ctx.Done():
+				c.conn.Close()
+				interrupted <- ctx.Err()
+			case <-done:
+				interrupted <- nil
+			}
+		}()
+	}
+
+	switch {
+	case c.keepAlive < 0 || c.idleTimeout < 0 || c.idleTimeout == 1:
+		c.handshakeErr = errInvalidKeepAlive //the keepalive ticker needs a positive interval
+	case c.isClient:
 		c.handshakeErr = c.RunClientHandshake()
-	} else {
+	default:
 		c.handshakeErr = c.RunServerHandshake()
-		if c.handshakeErr != nil {
-			//send plaintext error to client for debug
-			c.writePacket([]byte(c.handshakeErr.Error())) //don't care about result
+		if c.handshakeErr != nil && ctx.Err() == nil {
+			c.sendAlert(alertFor(c.handshakeErr)) //don't care about result
+		}
+	}
+	if e, ok := c.handshakeErr.(*localError); ok {
+		c.handshakeErr = e.err
+	}
+
+	if done != nil {
+		close(done)
+		if err := <-interrupted; err != nil {
+			// the connection is closed, report the cancellation
+			// rather than the I/O error it caused
+			c.handshakeErr = err
+			c.handshakeComplete = false
+		}
+	}
+
+	if c.handshakeComplete {
+		c.handshakeDuration = time.Since(start)
+		if c.cover != nil {
+			c.startCover()
+		}
+		if c.keepAlive > 0 || c.idleTimeout > 0 {
+			c.startKeepAlive()
 		}
 	}
 
@@ -427,6 +960,7 @@ func (c *Conn) RunClientHandshake() error {
 
 	var (
 		msg, payload []byte
+		prologue     []byte
 		states       []*noise.HandshakeState
 		err          error
 		csIn, csOut  *noise.CipherState
@@ -440,7 +974,10 @@ func (c *Conn) RunClientHandshake() error {
 
 	c.AddPacketSizeField(b)
 
-	if msg, _, states, err = ComposeInitiatorHandshakeMessages(c.myKeys, c.PeerKey, b.data, nil); err != nil {
+	patterns := c.registry.offeredPatterns(len(c.staticKeys) > 0, c.PeerKey, c.knownToServer, len(c.psk) > 0)
+	configs := c.registry.offeredConfigs(patterns, c.staticKeys, c.PeerKey)
+	if msg, prologue, states, configs, err = composeInitiatorHandshakeMessages(configs, c.staticKeys, c.PeerKey, c.psk, c.pskIdentity, b.data, nil); err != nil {
+		c.out.freeBlock(b)
 		return err
 	}
 
@@ -458,36 +995,58 @@ func (c *Conn) RunClientHandshake() error {
 	msg = c.input.data
 
 	//preliminary checks
-	if len(msg) < macSize+noise.DH25519.DHLen()+2 { // 2 is for index and IK's extra byte
+	if len(msg) == 0 || int(msg[0]) > (len(states)-1) {
 		c.in.freeBlock(c.input)
 		c.input = nil
-		return errors.New("message is too small")
+		return errors.New("message index out of bounds")
 	}
 
-	if int(msg[0]) > (len(states) - 1) {
+	index := msg[0]
+	hs := states[index]
+	cfg := configs[index]
+
+	if len(msg) < macSize+cfg.DH.DHLen()+1 { // 1 is for index
 		c.in.freeBlock(c.input)
 		c.input = nil
-		return errors.New("message index out of bounds")
+		return errors.New("message is too small")
 	}
 
 	//check for IK answer
-	hs := states[msg[0]]
 	offset := 1
-	if len(hs.PeerStatic()) > 0 {
-		mType := msg[1]
-
-		if mType != 0 {
+	if cfg.Pattern.Name == noise.HandshakeIK.Name {
+		switch msg[1] {
+		case 0: // pure IK
+		case 1: // server could not use our IK message, continue with XXfallback
+			fallback, ok := c.registry.fallbacks[cfg.NameKey]
+			if !ok {
+				c.in.freeBlock(c.input)
+				c.input = nil
+				return errors.New("fallback is not supported for " + string(cfg.Name))
+			}
+			cfg = fallback
+			hs = newFallbackState(cfg, c.staticKeys[cfg.DH.DHName()], hs.LocalEphemeral(), prologue)
+		default:
 			c.in.freeBlock(c.input)
 			c.input = nil
-			return errors.New("Only pure IK is supported")
+			return errors.New("unknown IK answer type")
 		}
 		offset = 2
 	}
+	msg = msg[offset:]
+
+	//hybrid suites carry the ML-KEM ciphertext in front of the noise message
+	if h := cfg.kem(); h != nil {
+		if msg, err = h.decapsulate(msg); err != nil {
+			c.in.freeBlock(c.input)
+			c.input = nil
+			return err
+		}
+	}
 
 	// cannot reuse msg for read, need another buf
 	inblock := c.in.newBlock()
 	inblock.reserve(len(msg))
-	payload, csIn, csOut, err = hs.ReadMessage(inblock.data, msg[offset:])
+	payload, csIn, csOut, err = hs.ReadMessage(inblock.data, msg)
 	if err != nil {
 		return err
 	}
@@ -495,13 +1054,18 @@ func (c *Conn) RunClientHandshake() error {
 	c.in.freeBlock(c.input)
 	c.input = nil
 
+	//the server answered with another key than the one we pinned, such as in XX or XXfallback
+	//after a failed IK offer. Only VerifyCallback may accept it
+	if len(c.PeerKey) > 0 && c.verifyCallback == nil && !bytes.Equal(hs.PeerStatic(), c.PeerKey) {
+		return errPeerKeyMismatch
+	}
 	if err = c.processPayload(hs.PeerStatic(), payload); err != nil {
 		return err
 	}
 
 	if csIn == nil && csOut == nil {
 		b = c.out.newBlock()
-		if len(c.PeerKey) == 0 {
+		if cfg.CanWrite(len(cfg.Pattern.Messages) - 1) { //we send our static key, so payload is encrypted
 			outBlockPayload := c.out.newBlock()
 			for _, f := range c.payload {
 				outBlockPayload.AddField(f.Data, f.Type)
@@ -529,16 +1093,20 @@ func (c *Conn) RunClientHandshake() error {
 
 	c.in.cs = csIn
 	c.out.cs = csOut
-	c.in.padding, c.out.padding = c.padding, c.padding
 	c.channelBinding = hs.ChannelBinding()
+	c.PeerKey = hs.PeerStatic()
+	c.myKeys = c.staticKeys[cfg.DH.DHName()]
+	c.handshakeConfig = cfg
+	c.messageIndex = index
 	c.handshakeComplete = true
+	atomic.StoreInt32(&c.transport, 1)
 	return nil
 }
 
 func (c *Conn) AddPacketSizeField(p *packet) {
-	if c.MaxPacketSize != 0 {
+	if c.maxRecv != 0 {
 		size := make([]byte, 2) //TODO reuse
-		binary.BigEndian.PutUint16(size, c.MaxPacketSize)
+		binary.BigEndian.PutUint16(size, c.maxRecv)
 		p.AddField(size, MessageTypeMaxPacketSize)
 	}
 }
@@ -549,29 +1117,39 @@ func (c *Conn) RunServerHandshake() error {
 	if err := c.readPacket(); err != nil {
 		return err
 	}
-	payload, hs, cfg, index, err := ParseHandshake(c.myKeys, c.input.data, c.HandshakeStrategy, nil)
+	payload, hs, cfg, index, err := c.registry.ParseHandshake(&ResponderKeys{
+		StaticKeys: c.staticKeys,
+		ClientKeys: c.clientKeys,
+		PSKLookup:  c.pskLookup,
+	}, c.input.data, c.suiteSelector, c.RemoteAddr(), nil)
 	c.in.freeBlock(c.input)
 	c.input = nil
 
+	if err == errNoSupportedProtocols {
+		return withAlert(AlertNoSupportedSuite, err)
+	}
 	if err != nil {
-		return err
+		return withAlert(AlertBadMessage, err)
 	}
-	currentMaxPacketSize := c.MaxPacketSize
 	if err = c.processPayload(hs.PeerStatic(), payload); err != nil {
 		return err
 	}
 
-	sendMaxPacketSize := c.MaxPacketSize == currentMaxPacketSize //do not send if overridden by client
-
 	b := c.out.newBlock()
 	b.resize(1)
 	b.data[0] = index
-	if len(hs.PeerStatic()) > 0 { //we answer to IK
+	if cfg.Pattern.Name == HandshakeXXfallback.Name { //IK failed, we initiate XXfallback
+		b.resize(2)
+		b.data[1] = 1
+	} else if cfg.Pattern.Name == noise.HandshakeIK.Name { //we answer to IK
 		b.resize(2)
-		b.data[1] = 0 // xx_fallback is not supported yet
+		b.data[1] = 0
+	}
+	if h := cfg.kem(); h != nil {
+		b.data = appendField(b.data, h.ct, MessageTypeKEMCiphertext)
 	}
 
-	//server can safely answer with payload as both XX and IK encrypt it
+	//server can safely answer with payload as every supported pattern encrypts it
 	off := len(b.data)
 
 	outBlock := c.out.newBlock()
@@ -580,9 +1158,7 @@ func (c *Conn) RunServerHandshake() error {
 		outBlock.AddField(f.Data, f.Type)
 	}
 
-	if sendMaxPacketSize {
-		c.AddPacketSizeField(outBlock)
-	}
+	c.AddPacketSizeField(outBlock)
 
 	b.reserve(len(outBlock.data) + 128)
 	b.data, csOut, csIn = hs.WriteMessage(b.data[:off], outBlock.data)
@@ -608,38 +1184,30 @@ func (c *Conn) RunServerHandshake() error {
 		c.input = nil
 
 		if err != nil {
-			return err
-		}
-
-		if err = c.processPayload(hs.PeerStatic(), payload); err != nil {
-			return err
+			return withAlert(AlertDecryptionFailed, err)
 		}
 
 		if csIn == nil || csOut == nil {
 			return errors.New("Not supported")
 		}
+
+		if err = c.processPayload(hs.PeerStatic(), payload); err != nil {
+			c.out.cs = csOut //the client is done, answer with an encrypted alert
+			return err
+		}
 	}
 
 	c.in.cs = csIn
 	c.out.cs = csOut
-	c.in.padding, c.out.padding = c.padding, c.padding
 	c.channelBinding = hs.ChannelBinding()
 	c.PeerKey = hs.PeerStatic()
+	c.myKeys = c.staticKeys[cfg.DH.DHName()]
 
-	info := &ConnectionInfo{
-		Name:          string(cfg.Name),
-		Index:         index,
-		PeerKey:       hs.PeerStatic(),
-		HandshakeHash: hs.ChannelBinding(),
-		ServerPublic:  c.myKeys.Public,
-	}
-	c.connectionInfo, err = json.MarshalIndent(info, " ", "	")
-
-	if err != nil {
-		return err
-	}
+	c.handshakeConfig = cfg
+	c.messageIndex = index
 
 	c.handshakeComplete = true
+	atomic.StoreInt32(&c.transport, 1)
 	return nil
 }
 
@@ -648,23 +1216,28 @@ func (c *Conn) processPayload(publicKey []byte, payload []byte) (err error) {
 	var msgs []*Field
 	if len(payload) > 0 {
 		if msgs, err = parseMessageFields(payload); err != nil {
-			return
+			return withAlert(AlertBadMessage, err)
 		}
 		for _, m := range msgs {
 			if m.Type == MessageTypeMaxPacketSize {
 				if len(m.Data) != uint16Size {
-					return errors.New("invalid field size")
+					return withAlert(AlertBadMessage, errors.New("invalid field size"))
 				}
 				max := binary.BigEndian.Uint16(m.Data)
 				if max < 128 {
-					return errors.New("invalid max packet size")
+					return withAlert(AlertBadMessage, errors.New("invalid max packet size"))
 				}
-				c.MaxPacketSize = max
+				c.maxSend = max
 			}
+			// payload buffers are reused, keep a copy
+			c.peerFields = append(c.peerFields, &Field{
+				Type: m.Type,
+				Data: append([]byte(nil), m.Data...),
+			})
 		}
 	}
 	if c.verifyCallback != nil {
-		return c.verifyCallback(publicKey, msgs)
+		return withAlert(AlertVerificationFailed, c.verifyCallback(publicKey, msgs))
 	}
 	return nil
 }
@@ -0,0 +1,858 @@
+package noisesocket
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/stretchr/testify/assert"
+)
+
+// connPair returns a client and a server Conn connected over loopback TCP,
+// so that writes such as close notify do not wait for the peer to read.
+func connPair(clientConfig, serverConfig *Config) (*Conn, *Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		panic(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		panic(err)
+	}
+	return Client(c, clientConfig), Server(s, serverConfig)
+}
+
+func TestClientServer(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	for _, peerKey := range [][]byte{nil, ks.Public} {
+		client, server := connPair(&Config{StaticKey: ki, PeerKey: peerKey}, &Config{StaticKey: ks})
+
+		msg := make([]byte, 70000)
+		rand.Read(msg)
+
+		go func() {
+			client.Write(msg)
+		}()
+
+		buf := make([]byte, len(msg))
+		_, err := io.ReadFull(server, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, buf)
+		assert.Equal(t, ki.Public, server.PeerKey)
+		assert.Equal(t, client.ChannelBinding(), server.ChannelBinding())
+
+		cs, ss := client.ConnectionState(), server.ConnectionState()
+		assert.True(t, cs.HandshakeComplete)
+		assert.True(t, ss.HandshakeComplete)
+		assert.Equal(t, cs.Protocol, ss.Protocol)
+		assert.Equal(t, cs.MessageIndex, ss.MessageIndex)
+		assert.Equal(t, ki.Public, cs.LocalStatic)
+		assert.Equal(t, ks.Public, cs.PeerStatic)
+		assert.Equal(t, ki.Public, ss.PeerStatic)
+		assert.Equal(t, ks.Public, ss.LocalStatic)
+		assert.Equal(t, cs.HandshakeHash, ss.HandshakeHash)
+		if peerKey == nil {
+			assert.Equal(t, "XX", cs.Pattern)
+		} else {
+			assert.Equal(t, "IK", cs.Pattern)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+type pipeRWC struct {
+	io.Reader
+	io.Writer
+}
+
+func (pipeRWC) Close() error {
+	return nil
+}
+
+func TestClientServerReadWriteCloser(t *testing.T) {
+
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+
+	client := Client(pipeRWC{cr, cw}, &Config{StaticKey: noise.DH25519.GenerateKeypair(rand.Reader)})
+	server := Server(pipeRWC{sr, sw}, &Config{StaticKey: ks})
+
+	assert.Error(t, client.SetDeadline(time.Time{}))
+
+	go func() {
+		client.Write([]byte("hello"))
+	}()
+
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(server, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), buf)
+}
+
+func TestHandshakeContextCancel(t *testing.T) {
+
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	c, s := net.Pipe()
+	defer s.Close()
+	client := Client(c, &Config{StaticKey: noise.DH25519.GenerateKeypair(rand.Reader), PeerKey: ks.Public})
+
+	// the peer reads the first message and never answers
+	go io.Copy(io.Discard, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := client.HandshakeContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// the handshake error is sticky
+	_, err = client.Write([]byte("data"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+
+	c, s := net.Pipe()
+	defer c.Close()
+	server := Server(s, &Config{
+		StaticKey:        noise.DH25519.GenerateKeypair(rand.Reader),
+		HandshakeTimeout: 50 * time.Millisecond,
+	})
+
+	// a stalled client never sends its first message
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- server.Handshake()
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			assert.Equal(t, context.DeadlineExceeded, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("handshake was not interrupted")
+		}
+	}
+}
+
+func TestXXfallback(t *testing.T) {
+
+	tests := []struct {
+		dh      noise.DHFunc
+		pattern string
+	}{
+		{DH448, "XXfallback"},
+		{noise.DH25519, "XXfallback"},
+	}
+
+	for _, test := range tests {
+		ki := test.dh.GenerateKeypair(rand.Reader)
+		ks := test.dh.GenerateKeypair(rand.Reader)
+		stale := test.dh.GenerateKeypair(rand.Reader)
+
+		clientFields := []*Field{{Type: MessageTypeCustomCert, Data: []byte("client")}}
+		serverFields := []*Field{{Type: MessageTypeCustomCert, Data: []byte("server")}}
+
+		// the server presents another key than the pinned one, the callback accepts it
+		verify := func(key []byte, _ []*Field) error {
+			if !bytes.Equal(key, ks.Public) {
+				return errors.New("unknown server")
+			}
+			return nil
+		}
+		client, server := connPair(
+			&Config{StaticKey: ki, PeerKey: stale.Public, Payload: clientFields, VerifyCallback: verify, Patterns: []string{"IK"}},
+			&Config{StaticKey: ks, Payload: serverFields},
+		)
+
+		go func() {
+			client.Write([]byte("hello"))
+		}()
+
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(server, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("hello"), buf)
+
+		cs, ss := client.ConnectionState(), server.ConnectionState()
+		assert.Equal(t, test.pattern, cs.Pattern)
+		assert.Equal(t, cs.Protocol, ss.Protocol)
+		assert.Equal(t, ks.Public, cs.PeerStatic)
+		assert.Equal(t, ki.Public, ss.PeerStatic)
+		assert.Equal(t, cs.HandshakeHash, ss.HandshakeHash)
+		assert.Equal(t, clientFields, ss.PeerFields)
+		assert.Equal(t, serverFields, cs.PeerFields)
+
+		client.Close()
+		server.Close()
+
+		// without a callback the pinned key is enforced, in XXfallback and XX
+		for _, patterns := range [][]string{{"IK"}, nil} {
+			client, server = connPair(&Config{StaticKey: ki, PeerKey: stale.Public, Patterns: patterns}, &Config{StaticKey: ks})
+			errs := make(chan error, 1)
+			go func() {
+				errs <- server.Handshake()
+			}()
+			assert.Equal(t, errPeerKeyMismatch, client.Handshake())
+			client.Close()
+			assert.Error(t, <-errs)
+			server.Close()
+		}
+	}
+}
+
+func TestPatterns(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+	other := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	tests := []struct {
+		pattern    string
+		client     *Config
+		clientKeys [][]byte
+	}{
+		{"NN", &Config{StaticKey: ki, Anonymous: true}, nil},
+		{"NK", &Config{StaticKey: ki, Anonymous: true, PeerKey: ks.Public}, nil},
+		{"KK", &Config{StaticKey: ki, KnownToServer: true, PeerKey: ks.Public}, [][]byte{other.Public, ki.Public}},
+		{"IK", &Config{StaticKey: ki, KnownToServer: true, PeerKey: ks.Public}, [][]byte{other.Public}},
+	}
+
+	for _, test := range tests {
+		client, server := connPair(test.client, &Config{StaticKey: ks, ClientKeys: test.clientKeys})
+
+		go func() {
+			client.Write([]byte("hello"))
+		}()
+
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(server, buf)
+		assert.NoError(t, err, test.pattern)
+		assert.Equal(t, []byte("hello"), buf)
+
+		cs, ss := client.ConnectionState(), server.ConnectionState()
+		assert.Equal(t, test.pattern, cs.Pattern)
+		assert.Equal(t, cs.Protocol, ss.Protocol)
+		assert.Equal(t, cs.HandshakeHash, ss.HandshakeHash)
+		if test.client.Anonymous {
+			assert.Empty(t, ss.PeerStatic, test.pattern)
+			assert.Empty(t, cs.LocalStatic, test.pattern)
+		} else {
+			assert.Equal(t, ki.Public, ss.PeerStatic, test.pattern)
+		}
+		if test.client.PeerKey != nil {
+			assert.Equal(t, ks.Public, cs.PeerStatic, test.pattern)
+		}
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestPSK(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	psk := make([]byte, 32)
+	rand.Read(psk)
+	lookup := func(identity []byte) ([]byte, error) {
+		if string(identity) != "device-1" {
+			return nil, errors.New("unknown device")
+		}
+		return psk, nil
+	}
+
+	tests := []struct {
+		pattern string
+		client  *Config
+	}{
+		{"XXpsk3", &Config{StaticKey: ki, PSK: psk, PSKIdentity: []byte("device-1")}},
+		{"IKpsk2", &Config{StaticKey: ki, PeerKey: ks.Public, PSK: psk, PSKIdentity: []byte("device-1")}},
+		{"NNpsk0", &Config{Anonymous: true, PSK: psk, PSKIdentity: []byte("device-1")}},
+	}
+
+	for _, test := range tests {
+		client, server := connPair(test.client, &Config{StaticKey: ks, PSKLookup: lookup})
+
+		go func() {
+			client.Write([]byte("hello"))
+		}()
+
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(server, buf)
+		assert.NoError(t, err, test.pattern)
+		assert.Equal(t, []byte("hello"), buf)
+
+		cs, ss := client.ConnectionState(), server.ConnectionState()
+		assert.Equal(t, "Noise_"+test.pattern+"_25519_AESGCM_SHA256", ss.Protocol)
+		assert.Equal(t, cs.Protocol, ss.Protocol)
+		assert.Equal(t, cs.HandshakeHash, ss.HandshakeHash)
+
+		client.Close()
+		server.Close()
+	}
+
+	// wrong key
+	wrong := make([]byte, 32)
+	client, server := connPair(&Config{StaticKey: ki, PSK: wrong, PSKIdentity: []byte("device-1")}, &Config{StaticKey: ks, PSKLookup: lookup})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Handshake()
+	}()
+	// the client completes XXpsk3 on its side, the server cannot read its last message
+	client.Handshake()
+	client.Close()
+	assert.Error(t, <-errs)
+}
+
+func TestCurve448(t *testing.T) {
+
+	a := DH448.GenerateKeypair(rand.Reader)
+	b := DH448.GenerateKeypair(rand.Reader)
+	assert.Len(t, a.Public, 56)
+	assert.Equal(t, DH448.DH(a.Private, b.Public), DH448.DH(b.Private, a.Public))
+
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks448 := DH448.GenerateKeypair(rand.Reader)
+	serverConfig := &Config{StaticKey: ks, StaticKeys: map[string]noise.DHKey{"448": ks448}}
+
+	tests := []struct {
+		protocol string
+		client   *Config
+		peerKey  []byte
+	}{
+		{"Noise_XX_448_AESGCM_SHA256", &Config{StaticKey: a}, ks448.Public},
+		{"Noise_IK_448_AESGCM_SHA256", &Config{StaticKey: a, PeerKey: ks448.Public}, ks448.Public},
+		{"Noise_XX_25519_AESGCM_SHA256", &Config{StaticKey: noise.DH25519.GenerateKeypair(rand.Reader)}, ks.Public},
+	}
+
+	for _, test := range tests {
+		client, server := connPair(test.client, serverConfig)
+
+		go func() {
+			client.Write([]byte("hello"))
+		}()
+
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(server, buf)
+		assert.NoError(t, err, test.protocol)
+		assert.Equal(t, []byte("hello"), buf)
+
+		cs, ss := client.ConnectionState(), server.ConnectionState()
+		assert.Equal(t, test.protocol, cs.Protocol)
+		assert.Equal(t, cs.Protocol, ss.Protocol)
+		assert.Equal(t, test.peerKey, cs.PeerStatic)
+		assert.Equal(t, test.peerKey, ss.LocalStatic)
+		assert.Equal(t, test.client.StaticKey.Public, ss.PeerStatic)
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestHybrid(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	// a server which does not know hybrid suites skips them
+	classic := NewDefaultRegistry()
+	classic.UnregisterFunc(func(cfg *HandshakeConfig) bool {
+		return cfg.kem() != nil
+	})
+
+	tests := []struct {
+		registry *Registry
+		protocol string
+	}{
+		{nil, "Noise_IK_25519+MLKEM768_AESGCM_SHA256"},
+		{classic, "Noise_IK_25519_AESGCM_SHA256"},
+	}
+
+	for _, test := range tests {
+		client, server := connPair(&Config{StaticKey: ki, PeerKey: ks.Public, CipherSuites: []string{"25519+MLKEM768_AESGCM_SHA256", "25519_AESGCM_SHA256"}},
+			&Config{StaticKey: ks, Registry: test.registry})
+
+		go func() {
+			client.Write([]byte("hello"))
+		}()
+
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(server, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("hello"), buf)
+
+		cs, ss := client.ConnectionState(), server.ConnectionState()
+		assert.Equal(t, test.protocol, cs.Protocol)
+		assert.Equal(t, cs.Protocol, ss.Protocol)
+		assert.Equal(t, cs.HandshakeHash, ss.HandshakeHash)
+
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestRekey(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	client, server := connPair(&Config{StaticKey: ki, RekeyAfterPackets: 3}, &Config{StaticKey: ks, Padding: 64})
+	defer client.Close()
+	defer server.Close()
+
+	msg := make([]byte, 100)
+	rand.Read(msg)
+	buf := make([]byte, 100)
+
+	// automatic rekey every 3 packets
+	go func() {
+		for i := 0; i < 10; i++ {
+			client.Write(msg)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		_, err := io.ReadFull(server, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, msg, buf)
+	}
+	assert.Equal(t, uint64(13), server.in.seq)
+	assert.Equal(t, uint64(1), server.in.packets)
+
+	// manual rekey rotates both directions
+	go func() {
+		assert.NoError(t, client.Rekey())
+		client.Write(msg)
+	}()
+	_, err := io.ReadFull(server, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, buf)
+	assert.Equal(t, uint64(1), server.in.packets)
+
+	go func() {
+		server.Write(msg)
+	}()
+	_, err = io.ReadFull(client, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, buf)
+	assert.Equal(t, uint64(1), client.in.packets)
+	assert.Equal(t, uint64(1), server.out.packets)
+
+	// the connection stops before the nonce runs out
+	client.out.seq = nonceLimit
+	_, err = client.Write(msg)
+	assert.Equal(t, errNonceExhausted, err)
+	assert.Equal(t, errNonceExhausted, client.Rekey())
+}
+
+func TestCloseNotify(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	client, server := connPair(&Config{StaticKey: ki}, &Config{StaticKey: ks})
+	assert.Equal(t, errEarlyCloseWrite, client.CloseWrite())
+
+	// half-close, the server reads the request until EOF and answers
+	go func() {
+		client.Write([]byte("hello"))
+		client.CloseWrite()
+	}()
+
+	req, err := io.ReadAll(server)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), req)
+
+	_, err = server.Write([]byte("bye"))
+	assert.NoError(t, err)
+	assert.NoError(t, server.Close())
+
+	resp, err := io.ReadAll(client)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("bye"), resp)
+
+	_, err = client.Write([]byte("again"))
+	assert.Equal(t, errShutdown, err)
+	client.Close()
+
+	// a truncated stream is not a clean EOF
+	client, server = connPair(&Config{StaticKey: ki}, &Config{StaticKey: ks})
+	go func() {
+		client.Write([]byte("hello"))
+		client.conn.Close()
+	}()
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(server, buf)
+	assert.NoError(t, err)
+	_, err = server.Read(buf)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	server.Close()
+
+	// close notify does not leave its own write deadline behind
+	c, s := connPair(&Config{StaticKey: ki}, &Config{StaticKey: ks})
+	deadlines := &deadlineConn{Conn: c.conn}
+	c.conn = deadlines
+	go io.Copy(io.Discard, s)
+	deadline := time.Now().Add(time.Hour)
+	assert.NoError(t, c.SetWriteDeadline(deadline))
+	assert.NoError(t, c.Handshake())
+	assert.NoError(t, c.CloseWrite())
+	assert.Equal(t, deadline, deadlines.write)
+	c.Close()
+	s.Close()
+}
+
+// deadlineConn records the last write deadline set on it
+type deadlineConn struct {
+	net.Conn
+	write time.Time
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.write = t
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func TestPacketFields(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	client, server := connPair(&Config{StaticKey: ki}, &Config{StaticKey: ks})
+	defer server.Close()
+
+	go func() {
+		assert.NoError(t, client.Handshake())
+
+		client.out.Lock()
+		defer client.out.Unlock()
+
+		//padding first, data split around a field nobody handles, then close notify
+		packet := client.InitializePacket()
+		packet.AddField(make([]byte, 10), MessageTypePadding)
+		packet.AddField([]byte("hel"), MessageTypeData)
+		packet.AddField([]byte("ignored"), 1000)
+		packet.AddField([]byte("lo"), MessageTypeData)
+		packet.AddField(nil, MessageTypeCloseNotify)
+		packet.AddField([]byte("lost"), MessageTypeData)
+		client.conn.Write(client.out.encryptIfNeeded(packet))
+	}()
+
+	data, err := io.ReadAll(server)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	client.Close()
+}
+
+func TestFields(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	const typeConfig, typeCancel = 2000, 2001
+
+	var pushed []string
+	serverConfig := &Config{StaticKey: ks, FieldHandlers: map[uint16]FieldHandler{
+		typeConfig: func(c *Conn, data []byte) error {
+			pushed = append(pushed, string(data))
+			return nil
+		},
+	}}
+
+	client, server := connPair(&Config{StaticKey: ki}, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	assert.Error(t, client.WriteField(MessageTypeRekey, nil))
+	assert.Equal(t, errReservedField, client.WriteField(MessageTypeCustomCert, nil))
+	assert.Equal(t, errReservedField, client.WriteField(MessageTypeSignature, nil))
+
+	registered := make(chan struct{})
+	go func() {
+		assert.NoError(t, client.WriteField(typeConfig, []byte("v1")))
+		client.Write([]byte("hel"))
+		assert.NoError(t, client.WriteField(typeCancel, []byte("dropped")))
+		assert.NoError(t, client.WriteField(typeConfig, []byte("v2")))
+		client.Write([]byte("lo"))
+		<-registered
+		assert.NoError(t, client.WriteField(typeCancel, []byte("stop")))
+	}()
+
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(server, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), buf)
+	assert.Equal(t, []string{"v1", "v2"}, pushed)
+	assert.Len(t, serverConfig.FieldHandlers, 1)
+
+	errCancelled := errors.New("cancelled")
+	server.HandleField(typeCancel, func(c *Conn, data []byte) error {
+		assert.Equal(t, []byte("stop"), data)
+		return errCancelled
+	})
+	close(registered)
+	_, err = server.Read(buf)
+	assert.Equal(t, errCancelled, err)
+}
+
+func TestPaddingPolicy(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	client, server := connPair(&Config{StaticKey: ki, PaddingPolicy: BucketPadding()}, &Config{StaticKey: ks})
+	defer client.Close()
+	defer server.Close()
+
+	go server.Handshake()
+	assert.NoError(t, client.Handshake())
+
+	buf := make([]byte, 10)
+	send := func(policy PaddingPolicy) Stats {
+		if policy != nil {
+			client.SetPaddingPolicy(policy)
+		}
+		before := client.Stats()
+		_, err := client.Write(buf)
+		assert.NoError(t, err)
+		_, err = io.ReadFull(server, buf)
+		assert.NoError(t, err)
+
+		after := client.Stats()
+		assert.Equal(t, before.PacketsSent+1, after.PacketsSent)
+		return Stats{
+			BytesSent:   after.BytesSent - before.BytesSent,
+			PaddingSent: after.PaddingSent - before.PaddingSent,
+		}
+	}
+
+	// data and padding fields and the MAC fill the smallest bucket
+	assert.Equal(t, Stats{BytesSent: 256, PaddingSent: 256 - 14 - 16}, send(nil))
+	assert.Equal(t, Stats{BytesSent: 100, PaddingSent: 100 - 14 - 16}, send(BlockPadding(100)))
+	assert.Equal(t, Stats{BytesSent: 14 + 16}, send(NoPadding))
+	assert.Equal(t, Stats{BytesSent: 14 + 16}, send(nil))
+
+	s := send(RandomPadding(5, 10))
+	assert.True(t, s.PaddingSent >= 9 && s.PaddingSent <= 14)
+
+	assert.Equal(t, uint64(5), client.Stats().PacketsSent)
+	assert.Equal(t, client.Stats().PaddingSent, server.Stats().PaddingReceived)
+	assert.Equal(t, client.Stats().BytesSent, server.Stats().BytesReceived)
+	assert.NotNil(t, server.ConnectionState().PaddingPolicy)
+
+	// the policy is a function and stays out of JSON
+	_, err := json.Marshal(client.ConnectionState())
+	assert.NoError(t, err)
+}
+
+func TestCoverTraffic(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	// a 512 byte packet every 5ms
+	cover := &CoverTraffic{Bandwidth: 512 * 200, PacketSize: 512, Burst: 4}
+	client, server := connPair(&Config{StaticKey: ki, CoverTraffic: cover}, &Config{StaticKey: ks})
+	defer client.Close()
+	defer server.Close()
+
+	msg := make([]byte, 3000)
+	rand.Read(msg)
+	fields := make(chan []byte, 1)
+	server.HandleField(MinFieldType, func(_ *Conn, data []byte) error {
+		fields <- append([]byte(nil), data...)
+		return nil
+	})
+
+	go func() {
+		assert.NoError(t, client.Handshake())
+		time.Sleep(50 * time.Millisecond)
+		n, err := client.Write(msg)
+		assert.NoError(t, err)
+		assert.Equal(t, len(msg), n)
+
+		// fields, rekeys and messages take slots of the schedule as well
+		assert.Equal(t, 488, client.MaxFieldSize())
+		assert.Equal(t, errFieldTooBig, client.WriteField(MinFieldType, make([]byte, 489)))
+		assert.NoError(t, client.WriteField(MinFieldType, []byte("field")))
+		assert.NoError(t, client.Rekey())
+		assert.NoError(t, client.WriteMessage(msg[:1000]))
+	}()
+
+	buf := make([]byte, len(msg))
+	_, err := io.ReadFull(server, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, buf)
+
+	res, err := server.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, msg[:1000], res)
+	assert.Equal(t, []byte("field"), <-fields)
+
+	// idle slots are filled with padding until the connection breaks
+	time.Sleep(50 * time.Millisecond)
+	client.conn.Close()
+	<-client.coverDone
+	_, err = client.Write(msg)
+	assert.Error(t, err)
+
+	stats := client.Stats()
+	assert.Equal(t, stats.PacketsSent*512, stats.BytesSent)
+	assert.True(t, stats.PacketsSent > 10, stats.PacketsSent)
+	// 7 packets carry data, 3 the message, 1 the field and 1 the rekey, each packet has a MAC
+	fieldBytes := len(msg) + 7*4 + 1000 + 3*4 + 5 + 4 + 1 + 4
+	assert.Equal(t, uint64(fieldBytes)+stats.PacketsSent*16, stats.BytesSent-stats.PaddingSent)
+}
+
+func TestKeepAlive(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	client, server := connPair(&Config{StaticKey: ki, KeepAlive: 10 * time.Millisecond},
+		&Config{StaticKey: ks, IdleTimeout: 50 * time.Millisecond})
+	defer client.Close()
+	defer server.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, server)
+		serverErr <- err
+	}()
+	go io.Copy(io.Discard, client)
+
+	// the pings keep the server from timing out
+	time.Sleep(150 * time.Millisecond)
+	assert.True(t, client.RTT() > 0)
+	assert.Equal(t, time.Duration(0), server.RTT())
+	select {
+	case err := <-serverErr:
+		t.Fatal(err)
+	default:
+	}
+
+	// pings arriving while the writer is blocked share one pong
+	client, server = connPair(&Config{StaticKey: ki}, &Config{StaticKey: ks})
+	defer client.Close()
+	defer server.Close()
+	go client.Handshake()
+	assert.NoError(t, server.Handshake())
+
+	server.out.Lock()
+	sent := server.Stats().PacketsSent
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, server.handlePing(make([]byte, 8)))
+	}
+	server.out.Unlock()
+	assert.Eventually(t, func() bool {
+		server.pongMutex.Lock()
+		defer server.pongMutex.Unlock()
+		return !server.pongSending
+	}, time.Second, time.Millisecond)
+	pongs := server.Stats().PacketsSent - sent
+	assert.True(t, pongs >= 1 && pongs <= 2, pongs)
+
+	// a silent peer is dropped
+	client, server = connPair(&Config{StaticKey: ki}, &Config{StaticKey: ks, IdleTimeout: 50 * time.Millisecond})
+	defer client.Close()
+	defer server.Close()
+
+	go client.Handshake()
+	_, err := server.Read(make([]byte, 1))
+	assert.Equal(t, ErrPeerTimeout, err)
+
+	// a connection that is only written is not dropped, its silent peer may be alive
+	client, server = connPair(&Config{StaticKey: ki, IdleTimeout: 20 * time.Millisecond}, &Config{StaticKey: ks})
+	defer client.Close()
+	defer server.Close()
+
+	go io.Copy(io.Discard, server)
+	for i := 0; i < 10; i++ {
+		_, err = client.Write([]byte("hello"))
+		assert.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the keepalive ticker needs a positive interval
+	for _, config := range []*Config{{StaticKey: ki, KeepAlive: -time.Second}, {StaticKey: ki, IdleTimeout: 1}} {
+		client, server = connPair(config, &Config{StaticKey: ks})
+		assert.Equal(t, errInvalidKeepAlive, client.Handshake())
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestMaxPacketSize(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	client, server := connPair(&Config{StaticKey: ki, MaxPacketSize: 500}, &Config{StaticKey: ks, MaxPacketSize: 2000})
+	defer client.Close()
+	defer server.Close()
+
+	go server.Handshake()
+	assert.NoError(t, client.Handshake())
+
+	state := client.ConnectionState()
+	assert.Equal(t, uint16(2000), state.MaxSendPacketSize)
+	assert.Equal(t, uint16(500), state.MaxRecvPacketSize)
+
+	// each side sends packets the other accepts
+	msg := make([]byte, 10000)
+	rand.Read(msg)
+	buf := make([]byte, len(msg))
+	go func() {
+		client.Write(msg)
+		server.Write(msg)
+	}()
+	_, err := io.ReadFull(server, buf)
+	assert.NoError(t, err)
+	_, err = io.ReadFull(client, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, buf)
+
+	assert.Equal(t, uint16(500), server.ConnectionState().MaxSendPacketSize)
+	assert.True(t, client.Stats().PacketsSent <= 6)
+	assert.True(t, server.Stats().PacketsSent >= 20)
+
+	// an oversized packet is refused before decryption
+	go func() {
+		client.out.Lock()
+		defer client.out.Unlock()
+
+		packet := client.InitializePacket()
+		packet.AddField(make([]byte, 3000), MessageTypeData)
+		client.conn.Write(client.out.encryptIfNeeded(packet))
+	}()
+
+	_, err = server.Read(buf)
+	assert.Equal(t, &PacketSizeError{Size: 3000 + msgHeaderSize + macSize, Max: 2000}, err)
+	_, err = client.Read(buf)
+	assert.Equal(t, &AlertError{Alert: AlertPacketTooLarge}, err)
+}
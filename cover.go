@@ -0,0 +1,200 @@
+package noisesocket
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCoverPacketSize is the packet size of cover traffic if CoverTraffic.PacketSize is not set.
+const DefaultCoverPacketSize = 1024
+
+// CoverTraffic configures the constant rate mode of a connection, which hides the timing
+// and volume of the data written. Once the handshake is done the connection sends packets
+// of the same size at a fixed rate. Write, WriteField, WriteMessage, Rekey, keepalive pings
+// and their pongs queue their records into the schedule and return once they have been sent,
+// idle slots get a packet that only carries padding. Rekeys due to limits take a slot as well.
+// Fields must fit in a packet, see MaxFieldSize.
+//
+// Only the alerts and the close notify that end a connection are sent outside of the schedule.
+type CoverTraffic struct {
+	// Bandwidth is the number of bytes per second the connection sends, data or not.
+	// It sets the rate of packets. Cover traffic is off if it is zero.
+	Bandwidth int
+
+	// PacketSize is the payload size of every packet, the MAC included. It is capped by
+	// the maximum packet size. If zero, DefaultCoverPacketSize is used.
+	PacketSize int
+
+	// Burst is the number of packets sent back to back to catch up with the schedule
+	// after the connection stalled. Slots missed beyond it are skipped.
+	// If zero, one packet is sent per slot.
+	Burst int
+}
+
+// a coverWrite is a record waiting for the schedule. Data and messages are split
+// across packets, other fields are sent in one
+type coverWrite struct {
+	data    []byte
+	msgType uint16
+	n       int
+	done    chan error
+}
+
+// next returns the part of w the next packet carries and its field type
+func (w *coverWrite) next(capacity int) ([]byte, uint16) {
+	data, msgType := w.data[w.n:], w.msgType
+	if len(data) > capacity {
+		data = data[:capacity]
+		if msgType == MessageTypeMessage {
+			msgType = MessageTypeMessageFragment
+		}
+	}
+	return data, msgType
+}
+
+// minCoverPacketSize leaves room for a byte of data, its field, the padding field and the MAC
+const minCoverPacketSize = macSize + msgHeaderSize*2 + 1
+
+// startCover starts sending cover traffic, once the handshake is done
+func (c *Conn) startCover() {
+	c.coverQueue = make(chan *coverWrite)
+	c.coverDone = make(chan struct{})
+
+	size := c.cover.PacketSize
+	if size == 0 {
+		size = DefaultCoverPacketSize
+	}
+	if max := c.maxSend; max != 0 && size > int(max) {
+		size = int(max)
+	}
+	if size > MaxPayloadSize {
+		size = MaxPayloadSize
+	}
+	if size < minCoverPacketSize {
+		size = minCoverPacketSize
+	}
+	c.coverCapacity = size - macSize - msgHeaderSize*2
+
+	interval := time.Duration(int64(time.Second) * int64(size) / int64(c.cover.Bandwidth))
+	if interval <= 0 {
+		interval = 1
+	}
+	burst := c.cover.Burst
+	if burst < 1 {
+		burst = 1
+	}
+
+	go c.coverLoop(size, interval, burst)
+}
+
+// coverLoop sends a packet of size bytes every interval until the connection fails or is closed
+func (c *Conn) coverLoop(size int, interval time.Duration, burst int) {
+	defer close(c.coverDone)
+
+	padding := PaddingFunc(func(n, _ int) int {
+		return size - n
+	})
+
+	var pending *coverWrite
+	next := time.Now()
+
+	for {
+		now := time.Now()
+		if oldest := now.Add(-time.Duration(burst-1) * interval); next.Before(oldest) {
+			next = oldest
+		}
+
+		for !next.After(now) {
+			if pending == nil {
+				select {
+				case pending = <-c.coverQueue:
+				default:
+				}
+			}
+
+			sent, err := c.writeCover(pending, padding)
+			if err != nil {
+				if pending != nil {
+					pending.done <- err
+				}
+				return
+			}
+
+			if sent && pending.n == len(pending.data) {
+				pending.done <- nil
+				pending = nil
+			}
+			next = next.Add(interval)
+		}
+
+		time.Sleep(time.Until(next))
+	}
+}
+
+// writeCover sends a packet of the schedule, padded by padding. It carries a rekey if one
+// is due, else the next part of w if there is one. It reports whether w was sent from
+func (c *Conn) writeCover(w *coverWrite, padding PaddingPolicy) (bool, error) {
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if err := c.out.err; err != nil {
+		return false, err
+	}
+	if err := c.out.checkNonce(); err != nil {
+		return false, c.out.setErrorLocked(err)
+	}
+
+	packet := c.InitializePacket()
+	var data []byte
+	rekey := c.rekeyDueLocked()
+	switch {
+	case rekey:
+		packet.AddField([]byte{0}, MessageTypeRekey)
+		w = nil
+	case w != nil:
+		var msgType uint16
+		data, msgType = w.next(c.coverCapacity)
+		packet.AddField(data, msgType)
+		rekey = msgType == MessageTypeRekey
+	}
+	if n := packet.AddPadding(padding, MaxPayloadSize); n > 0 {
+		atomic.AddUint64(&c.out.padding, uint64(n))
+	}
+
+	b := c.out.encryptIfNeeded(packet)
+	c.out.freeBlock(packet)
+
+	if _, err := c.conn.Write(b); err != nil {
+		return false, c.out.setErrorLocked(err)
+	}
+	if rekey {
+		c.out.rekey()
+	}
+	if w != nil {
+		w.n += len(data)
+	}
+	return w != nil, nil
+}
+
+// queueCover hands a record to the schedule and waits until it has been sent.
+// It returns the number of bytes sent
+func (c *Conn) queueCover(b []byte, msgType uint16) (int, error) {
+	if len(b) == 0 && msgType == MessageTypeData {
+		return 0, nil
+	}
+	if len(b) > c.coverCapacity && msgType != MessageTypeData && msgType != MessageTypeMessage {
+		return 0, errFieldTooBig
+	}
+
+	w := &coverWrite{data: b, msgType: msgType, done: make(chan error, 1)}
+	select {
+	case c.coverQueue <- w:
+	case <-c.coverDone:
+		c.out.Lock()
+		defer c.out.Unlock()
+		return 0, c.out.err
+	}
+
+	err := <-w.done
+	return w.n, err
+}
@@ -0,0 +1,38 @@
+package noisesocket
+
+import (
+	"crypto/rand"
+	"io"
+
+	"github.com/cloudflare/circl/dh/x448"
+	"github.com/flynn/noise"
+)
+
+// DH448 is the Curve448 DH function
+var DH448 noise.DHFunc = dh448{}
+
+type dh448 struct{}
+
+func (dh448) GenerateKeypair(rng io.Reader) noise.DHKey {
+	var pubkey, privkey x448.Key
+	if rng == nil {
+		rng = rand.Reader
+	}
+	if _, err := io.ReadFull(rng, privkey[:]); err != nil {
+		panic(err)
+	}
+	x448.KeyGen(&pubkey, &privkey)
+	return noise.DHKey{Private: privkey[:], Public: pubkey[:]}
+}
+
+func (dh448) DH(privkey, pubkey []byte) []byte {
+	var dst, in, base x448.Key
+	copy(in[:], privkey)
+	copy(base[:], pubkey)
+	// low order public keys give an all zero result, which the Noise spec allows
+	x448.Shared(&dst, &in, &base)
+	return dst[:]
+}
+
+func (dh448) DHLen() int     { return x448.Size }
+func (dh448) DHName() string { return "448" }
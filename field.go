@@ -9,6 +9,16 @@ const (
 	MessageTypeData uint16 = iota
 	MessageTypePadding
 	MessageTypeMaxPacketSize
+	MessageTypePSKIdentity
+	MessageTypeKEMKey
+	MessageTypeKEMCiphertext
+	MessageTypeRekey
+	MessageTypeCloseNotify
+	MessageTypeAlert
+	MessageTypeMessageFragment
+	MessageTypeMessage
+	MessageTypePing
+	MessageTypePong
 	MessageTypeCustomCert = 1024
 	MessageTypeSignature  = 1025
 )
@@ -29,24 +39,28 @@ func parseMessageFields(payload []byte) ([]*Field, error) {
 
 	msgs := make([]*Field, 0, 1)
 
-	off := uint16(0)
-	for {
-		msgLen := binary.BigEndian.Uint16(payload[off:])
-		if int(off+msgLen) > len(payload) {
+	for off := 0; off < len(payload); {
+		if len(payload)-off < msgHeaderSize {
+			return nil, errors.New("truncated field")
+		}
+		msgLen := int(binary.BigEndian.Uint16(payload[off:]))
+		if msgLen < uint16Size || off+uint16Size+msgLen > len(payload) {
 			return nil, errors.New("invalid size")
 		}
 
-		off += 2
-		msgType := binary.BigEndian.Uint16(payload[off:])
-		off += 2
 		msgs = append(msgs, &Field{
-			Type: msgType,
-			Data: payload[off : off+msgLen-uint16Size],
+			Type: binary.BigEndian.Uint16(payload[off+uint16Size:]),
+			Data: payload[off+msgHeaderSize : off+uint16Size+msgLen],
 		})
-		off += msgLen - uint16Size
-		if int(off) >= (len(payload) - msgHeaderSize) {
-			break
-		}
+		off += uint16Size + msgLen
 	}
 	return msgs, nil
 }
+
+// appendField appends a field (2 byte length, 2 byte type, data) to b
+func appendField(b []byte, data []byte, msgType uint16) []byte {
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-4:], uint16(len(data)+uint16Size))
+	binary.BigEndian.PutUint16(b[len(b)-2:], msgType)
+	return append(b, data...)
+}
@@ -0,0 +1,53 @@
+package noisesocket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMessageFields(t *testing.T) {
+
+	tests := []struct {
+		payload []byte
+		fields  []*Field
+		err     bool
+	}{
+		{nil, nil, false},
+		{[]byte{0, 2, 0, 1}, []*Field{{Type: 1, Data: []byte{}}}, false},
+		{[]byte{0, 3, 0, 0, 'a', 0, 2, 0, 7}, []*Field{{Type: 0, Data: []byte("a")}, {Type: 7, Data: []byte{}}}, false},
+		{[]byte{0, 2, 0}, nil, true},                          // header cut short
+		{[]byte{0, 1, 0, 0}, nil, true},                       // length without the type
+		{[]byte{0, 0, 0, 0}, nil, true},                       // zero length
+		{[]byte{0, 4, 0, 0, 'a'}, nil, true},                  // data cut short
+		{[]byte{0, 3, 0, 0, 'a', 0, 2, 0}, nil, true},         // second header cut short
+		{[]byte{0, 3, 0, 0, 'a', 0, 5, 0, 0, 'b'}, nil, true}, // second data cut short
+		{[]byte{0, 2, 0, 0, 0xff, 0xff, 0, 0}, nil, true},     // length beyond the payload
+	}
+
+	for _, test := range tests {
+		fields, err := parseMessageFields(test.payload)
+		if test.err {
+			assert.Error(t, err, "%v", test.payload)
+			continue
+		}
+		assert.NoError(t, err, "%v", test.payload)
+		assert.Equal(t, test.fields, fields)
+	}
+}
+
+func FuzzParseMessageFields(f *testing.F) {
+	f.Add([]byte{0, 3, 0, 0, 'a', 0, 2, 0, 7})
+	f.Add([]byte{0, 4, 0, 0, 'a'})
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		fields, err := parseMessageFields(payload)
+		if err != nil {
+			return
+		}
+		var b []byte
+		for _, f := range fields {
+			b = appendField(b, f.Data, f.Type)
+		}
+		assert.Equal(t, len(payload), len(b))
+	})
+}
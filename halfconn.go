@@ -3,7 +3,9 @@ package noisesocket
 import (
 	"encoding/binary"
 	"errors"
+	"math"
 	"sync"
+	"sync/atomic"
 
 	"github.com/flynn/noise"
 )
@@ -14,15 +16,26 @@ type halfConn struct {
 	cs      *noise.CipherState
 	err     error
 	bfree   *packet // list of free blocks
-	padding uint16
+	seq     uint64  // packets processed by cs, its nonce
+	packets uint64  // packets processed since the last rekey
+	bytes   uint64  // payload bytes processed since the last rekey
+	total   uint64  // atomic, packets processed by cs
+	size    uint64  // atomic, payload bytes processed by cs
+	padding uint64  // atomic, padding bytes processed by cs
 }
 
 const (
 	uint16Size    = 2  // uint16 takes 2 bytes
 	msgHeaderSize = 4  // message inside packet has type and length
 	macSize       = 16 // GCM and Poly1305 add 16 byte MACs
+
+	// nonceLimit is the number of packets after which a cipher refuses to go further,
+	// leaving a margin below the nonce 2^64-1 reserved by Noise
+	nonceLimit = math.MaxUint64 - 1<<16
 )
 
+var errNonceExhausted = errors.New("noisesocket: nonce space exhausted, the connection must be reestablished")
+
 // encryptIfNeeded prepares packet structure depending on padding and data length.
 // It also encrypts it if cipher is set up (handshake is done)
 func (h *halfConn) encryptIfNeeded(block *packet) []byte {
@@ -35,6 +48,7 @@ func (h *halfConn) encryptIfNeeded(block *packet) []byte {
 		}
 
 		block.data = h.cs.Encrypt(block.data[:uint16Size], nil, block.data[uint16Size:])
+		h.count(payloadSize)
 		binary.BigEndian.PutUint16(block.data, uint16(payloadSize))
 
 		return block.data
@@ -67,6 +81,7 @@ func (h *halfConn) decryptIfNeeded(b *packet) (data []byte, err error) {
 	}
 
 	if h.cs != nil {
+		h.count(len(payload))
 		payload, err = h.cs.Decrypt(payload[:0], nil, payload)
 		if err != nil {
 			return nil, err
@@ -77,6 +92,35 @@ func (h *halfConn) decryptIfNeeded(b *packet) (data []byte, err error) {
 	return payload, nil
 }
 
+// count records a packet of n bytes processed by the cipher
+func (h *halfConn) count(n int) {
+	h.seq++
+	h.packets++
+	h.bytes += uint64(n)
+	atomic.AddUint64(&h.total, 1)
+	atomic.AddUint64(&h.size, uint64(n))
+}
+
+// checkNonce returns an error once the cipher has processed nonceLimit packets
+func (h *halfConn) checkNonce() error {
+	if h.cs != nil && h.seq >= nonceLimit {
+		return errNonceExhausted
+	}
+	return nil
+}
+
+// rekeyDue reports whether the key has been used for maxBytes or maxPackets, 0 means no limit
+func (h *halfConn) rekeyDue(maxBytes, maxPackets uint64) bool {
+	return (maxBytes != 0 && h.bytes >= maxBytes) || (maxPackets != 0 && h.packets >= maxPackets)
+}
+
+// rekey rotates the key of cs. The nonce keeps counting
+func (h *halfConn) rekey() {
+	h.cs.Rekey()
+	h.packets = 0
+	h.bytes = 0
+}
+
 func (h *halfConn) setErrorLocked(err error) error {
 	h.err = err
 	return err
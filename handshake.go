@@ -1,6 +1,7 @@
 package noisesocket
 
 import (
+	"crypto/mlkem"
 	"encoding/binary"
 	"math"
 
@@ -8,118 +9,254 @@ import (
 
 	"bytes"
 	"io"
+	"net"
 
 	"github.com/flynn/noise"
 	"github.com/pkg/errors"
 )
 
+const pskSize = 32
+
+var errNoSupportedProtocols = errors.New("no supported protocols found")
+
+// HandshakeMessage is a protocol offered in the initiator's first packet.
 type HandshakeMessage struct {
-	Config  *HandshakeConfig
-	Message []byte
+	Config   *HandshakeConfig
+	Message  []byte
+	Index    byte // position among all sub-messages of the packet, including unknown ones
+	Priority int  // rank in the responder's registry, lower is preferred
 }
 
+// ComposeInitiatorHandshakeMessages builds the initiator's first packet offering XX, and IK if rs is provided.
+// If s is empty, the initiator stays anonymous and offers NN, and NK if rs is provided.
+// Only the suites whose DH function matches the sizes of s and rs are offered.
 func ComposeInitiatorHandshakeMessages(s noise.DHKey, rs []byte, payload []byte, ePrivate []byte) (msg []byte, prologue []byte, states []*noise.HandshakeState, err error) {
+	return defaultRegistry.ComposeInitiatorHandshakeMessages(s, rs, payload, ePrivate)
+}
 
-	if len(rs) != 0 && len(rs) != noise.DH25519.DHLen() {
-		return nil, nil, nil, errors.New("only 32 byte curve25519 public keys are supported")
-	}
-	res := make([]byte, 0, 2048)
-
-	usedPatterns := []noise.HandshakePattern{noise.HandshakeXX}
+// ComposeInitiatorHandshakeMessages is like the package function, offering the protocols of r.
+func (r *Registry) ComposeInitiatorHandshakeMessages(s noise.DHKey, rs []byte, payload []byte, ePrivate []byte) (msg []byte, prologue []byte, states []*noise.HandshakeState, err error) {
+	keys := r.staticKeys(s, nil)
+	configs := r.offeredConfigs(r.offeredPatterns(len(keys) > 0, rs, false, false), keys, rs)
+	msg, prologue, states, _, err = composeInitiatorHandshakeMessages(configs, keys, rs, nil, nil, payload, ePrivate)
+	return msg, prologue, states, err
+}
 
-	prologue = make([]byte, 1, 1024)
+// staticKeys returns one static keypair per DH function name of the registry.
+// Keys from extra take precedence, s is used for the DH functions of its size
+func (r *Registry) staticKeys(s noise.DHKey, extra map[string]noise.DHKey) map[string]noise.DHKey {
+	keys := make(map[string]noise.DHKey)
+	for _, dh := range r.dhs {
+		if k := staticKey(dh, s, extra); len(k.Public) > 0 {
+			keys[dh.DHName()] = k
+		}
+	}
+	return keys
+}
 
-	//we checked this in init
-	prologue[0] = byte(len(protoCipherPriorities[noise.HandshakeXX.Name]))
+func staticKey(dh noise.DHFunc, s noise.DHKey, extra map[string]noise.DHKey) noise.DHKey {
+	if k, ok := extra[dh.DHName()]; ok {
+		return k
+	}
+	if len(s.Public) == dh.DHLen() {
+		return s
+	}
+	return noise.DHKey{}
+}
 
-	prologue = append(prologue, prologues[noise.HandshakeXX.Name]...)
+// offeredPatterns returns the patterns an initiator can offer with its keys.
+// knownToResponder means that the responder has the initiator's static key pre-provisioned, which enables KK.
+// An initiator with a PSK offers psk patterns only
+func (r *Registry) offeredPatterns(hasStatic bool, rs []byte, knownToResponder bool, usePSK bool) []PatternConfig {
+	var patterns []PatternConfig
+	for _, p := range r.patterns {
+		if p.PSK != usePSK {
+			continue
+		}
+		if p.UseLocalKey != hasStatic {
+			continue
+		}
+		if p.UseRemoteKey && len(rs) == 0 {
+			continue
+		}
+		if p.LocalKeyKnown && !knownToResponder {
+			continue
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
 
-	//add IK if remote static is provided
-	if len(rs) > 0 {
-		usedPatterns = append(usedPatterns, noise.HandshakeIK)
-		prologue = append(prologue, prologues[noise.HandshakeIK.Name]...)
+// composeInitiatorHandshakeMessages offers configs. It returns a state and a config per offered protocol,
+// configs of hybrid suites are replaced with copies holding the ML-KEM state
+func composeInitiatorHandshakeMessages(configs []*HandshakeConfig, keys map[string]noise.DHKey, rs []byte, psk []byte, pskIdentity []byte, payload []byte, ePrivate []byte) (msg []byte, prologue []byte, states []*noise.HandshakeState, stateConfigs []*HandshakeConfig, err error) {
 
-		if len(protoCipherPriorities[noise.HandshakeIK.Name])+int(prologue[0]) > math.MaxUint8 {
-			return nil, nil, nil, errors.New("too many sub-messages for a single message")
-		}
+	if len(configs) == 0 {
+		return nil, nil, nil, nil, errors.New("no protocols to offer, check the key sizes")
+	}
+	if len(configs) > math.MaxUint8 {
+		return nil, nil, nil, nil, errors.New("too many sub-messages for a single message")
+	}
+	if len(psk) != 0 && len(psk) != pskSize {
+		return nil, nil, nil, nil, errors.New("pre-shared key must be 32 bytes")
+	}
+	res := make([]byte, 0, 2048)
 
-		prologue[0] += byte(len(protoCipherPriorities[noise.HandshakeIK.Name]))
+	prologue = make([]byte, 1, 1024)
+	prologue[0] = byte(len(configs))
+	for _, cfg := range configs {
+		prologue = append(prologue, cfg.NameLength)
+		prologue = append(prologue, cfg.Name...)
 	}
 
-	states = make([]*noise.HandshakeState, 0, prologue[0])
+	states = make([]*noise.HandshakeState, 0, len(configs))
+	stateConfigs = make([]*HandshakeConfig, 0, len(configs))
 
-	for _, pattern := range usedPatterns {
+	//one ML-KEM key is offered in every hybrid suite
+	var dk *mlkem.DecapsulationKey768
+	for _, cfg := range configs {
+		if cfg.kem() != nil {
+			if dk, err = mlkem.GenerateKey768(); err != nil {
+				return nil, nil, nil, nil, err
+			}
+			break
+		}
+	}
 
-		for _, csp := range protoCipherPriorities[pattern.Name] {
-			cfg := handshakeConfigs[csp]
+	for _, cfg := range configs {
+		cfg = cfg.withKEM(dk)
+		msg := res[len(res):] //append to res
 
-			msg := res[len(res):] //append to res
+		//append message type : 1 byte len + len bytes type name
 
-			//append message type : 1 byte len + len bytes type name
+		msg = append(msg, cfg.NameLength)
+		msg = append(msg, cfg.Name...)
 
-			msg = append(msg, cfg.NameLength)
-			msg = append(msg, cfg.Name...)
+		res = append(res, msg...)
 
-			res = append(res, msg...)
+		//reset position
+		msg = msg[len(msg):]
 
-			//reset position
-			msg = msg[len(msg):]
+		//append cipher suite contents : 2 byte len + len bytes message.
 
-			//append cipher suite contents : 2 byte len + len bytes message.
+		msg = append(msg, 0, 0) // add 2 bytes for length
 
-			msg = append(msg, 0, 0) // add 2 bytes for length
+		//psk identity goes unencrypted in front of the noise message, so that the responder can look up the key
+		if cfg.PSK {
+			msg = appendField(msg, pskIdentity, MessageTypePSKIdentity)
+		}
 
-			rs := rs
-			if !cfg.UseRemoteStatic {
-				rs = nil
-			}
-			var random io.Reader
-			if len(ePrivate) == 0 {
-				random = rand.Reader
-			} else {
-				random = bytes.NewBuffer(ePrivate)
-			}
-			state := noise.NewHandshakeState(noise.Config{
-				StaticKeypair: s,
-				Initiator:     true,
-				Pattern:       cfg.Pattern,
-				CipherSuite:   noise.NewCipherSuite(cfg.DH, cfg.Cipher, cfg.Hash),
-				PeerStatic:    rs,
-				Prologue:      prologue,
-				Random:        random,
-			})
+		rs := rs
+		if !cfg.UseRemoteStatic {
+			rs = nil
+		}
+		var s noise.DHKey
+		if cfg.UseLocalStatic {
+			s = keys[cfg.DH.DHName()]
+		}
+		var random io.Reader
+		if len(ePrivate) == 0 {
+			random = rand.Reader
+		} else {
+			random = bytes.NewBuffer(ePrivate)
+		}
+		state := noise.NewHandshakeState(noise.Config{
+			StaticKeypair: s,
+			Initiator:     true,
+			Pattern:       cfg.Pattern,
+			CipherSuite:   noise.NewCipherSuite(cfg.DH, cfg.Cipher, cfg.Hash),
+			PeerStatic:    rs,
+			Prologue:      prologue,
+			Random:        random,
+
+			PresharedKey:          cfg.psk(psk),
+			PresharedKeyPlacement: cfg.PSKPlacement,
+		})
+
+		msgPayload := payload
+		if !cfg.CanWrite(0) {
+			msgPayload = nil
+		}
+		if h := cfg.kem(); h != nil {
+			msgPayload = append(appendField(nil, h.dk.EncapsulationKey().Bytes(), MessageTypeKEMKey), msgPayload...)
+		}
+		msg, _, _ = state.WriteMessage(msg, msgPayload)
 
-			if CanWrite(cfg.Pattern, 0) {
-				msg, _, _ = state.WriteMessage(msg, payload)
-			} else {
-				msg, _, _ = state.WriteMessage(msg, nil)
-			}
+		binary.BigEndian.PutUint16(msg, uint16(len(msg)-uint16Size)) //write calculated length at the beginning
 
-			binary.BigEndian.PutUint16(msg, uint16(len(msg)-uint16Size)) //write calculated length at the beginning
+		states = append(states, state)
+		stateConfigs = append(stateConfigs, cfg)
 
-			states = append(states, state)
+		// we cannot send the message if its length exceeds 2^16 - 1
+		if len(res)+len(msg) > (math.MaxUint16 - uint16Size) {
+			return nil, nil, nil, nil, errors.New("Message is too big")
+		}
+		res = append(res, msg...)
+	}
+	return res, prologue, states, stateConfigs, nil
+}
 
-			// we cannot send the message if its length exceeds 2^16 - 1
-			if len(res)+len(msg) > (math.MaxUint16 - uint16Size) {
-				return nil, nil, nil, errors.New("Message is too big")
+// offeredConfigs returns the protocols of patterns the initiator has keys for,
+// in the order composeInitiatorHandshakeMessages offers them
+func (r *Registry) offeredConfigs(patterns []PatternConfig, keys map[string]noise.DHKey, rs []byte) []*HandshakeConfig {
+	var configs []*HandshakeConfig
+	for _, pattern := range patterns {
+		for _, csp := range r.suites[pattern.FullName()] {
+			cfg := r.configs[csp]
+			if cfg.optIn {
+				continue
 			}
-			res = append(res, msg...)
-
+			if _, ok := keys[cfg.DH.DHName()]; cfg.UseLocalStatic && !ok {
+				continue
+			}
+			if cfg.UseRemoteStatic && len(rs) != cfg.DH.DHLen() {
+				continue
+			}
+			configs = append(configs, cfg)
 		}
 	}
-	return res, prologue, states, nil
+	return configs
 }
 
+// CanWrite reports whether the payload of the message msgIndex is encrypted,
+// that is, whether a DH has been done by the time it is written
 func CanWrite(pattern noise.HandshakePattern, msgIndex int) bool {
-	for _, m := range pattern.Messages[msgIndex] {
-		if m == noise.MessagePatternS {
-			return true
+	for _, msg := range pattern.Messages[:msgIndex+1] {
+		for _, m := range msg {
+			switch m {
+			case noise.MessagePatternDHEE, noise.MessagePatternDHES, noise.MessagePatternDHSE, noise.MessagePatternDHSS:
+				return true
+			}
 		}
 	}
 	return false
 }
 
-func ParseHandshake(s noise.DHKey, handshake []byte, prefferedIndex int, ePrivate []byte) (payload []byte, hs *noise.HandshakeState, hcfg *HandshakeConfig, messageIndex byte, err error) {
+// PSKLookupFunc returns the pre-shared key for the identity the initiator sent.
+type PSKLookupFunc func(identity []byte) ([]byte, error)
+
+// ResponderKeys holds the key material a responder uses to read the initiator's first message.
+type ResponderKeys struct {
+	Static     noise.DHKey            // responder static keypair, used for the DH functions of its size
+	StaticKeys map[string]noise.DHKey // responder static keypairs by DH function name, take precedence over Static
+	ClientKeys [][]byte               // pre-provisioned initiator static keys that allow KK
+	PSKLookup  PSKLookupFunc          // pre-shared key lookup for psk patterns, psk patterns are rejected if nil
+}
+
+// static returns the responder static keypair for suites using dh
+func (k *ResponderKeys) static(dh noise.DHFunc) noise.DHKey {
+	return staticKey(dh, k.Static, k.StaticKeys)
+}
+
+// ParseHandshake reads the initiator's first packet and answers the first offer
+// chosen by selector that it can read. A nil selector means ServerPreference.
+// remote is the initiator's address passed to the selector.
+func ParseHandshake(keys *ResponderKeys, handshake []byte, selector SuiteSelector, remote net.Addr, ePrivate []byte) (payload []byte, hs *noise.HandshakeState, hcfg *HandshakeConfig, messageIndex byte, err error) {
+	return defaultRegistry.ParseHandshake(keys, handshake, selector, remote, ePrivate)
+}
+
+// ParseHandshake is like the package function, accepting the protocols of r.
+func (r *Registry) ParseHandshake(keys *ResponderKeys, handshake []byte, selector SuiteSelector, remote net.Addr, ePrivate []byte) (payload []byte, hs *noise.HandshakeState, hcfg *HandshakeConfig, messageIndex byte, err error) {
 
 	parsedPrologue := make([]byte, 1, 1024)
 	messages := make([]*HandshakeMessage, 0, 16)
@@ -152,12 +289,13 @@ func ParseHandshake(s noise.DHKey, handshake []byte, prefferedIndex int, ePrivat
 		//lookup protocol config
 
 		nameKey := HashKey(typeName)
-		cfg, ok := handshakeConfigs[nameKey]
+		cfg, ok := r.configs[nameKey]
 		if ok {
 
 			messages = append(messages, &HandshakeMessage{
 				Config:  cfg,
 				Message: msg,
+				Index:   parsedPrologue[0],
 			})
 		}
 
@@ -172,64 +310,160 @@ func ParseHandshake(s noise.DHKey, handshake []byte, prefferedIndex int, ePrivat
 		random = bytes.NewBuffer(ePrivate)
 	}
 
-	//choose protocol that we want to use, according to server priorities
-	if prefferedIndex == -1 {
-		for _, pr := range protoPriorities {
-		l:
-			for _, p := range protoCipherPriorities[pr] {
-				for i, m := range messages {
-					if p == m.Config.NameKey {
-
-						state, payload, err := getState(m, s, parsedPrologue, random)
-
-						if err != nil {
-							break l //try XX if IK did not work
-							return nil, nil, nil, 0, err
-						}
-
-						return payload, state, m.Config, byte(i), nil
-					}
+	//rank offers by server preference
+	rank := 0
+	for _, pr := range r.priorities {
+		for _, p := range r.suites[pr] {
+			for _, m := range messages {
+				if p == m.Config.NameKey {
+					m.Priority = rank
 				}
-
 			}
+			rank++
 		}
-	} else if prefferedIndex == -2 { //random
+	}
 
-		rndMsgs := make(map[int]*HandshakeMessage) //map will shuffle the order
-		for i, m := range messages {
-			rndMsgs[i] = m
-		}
+	if selector == nil {
+		selector = ServerPreference
+	}
 
-		for i, m := range rndMsgs {
-			state, payload, err := getState(m, s, parsedPrologue, random)
-			if err == nil {
-				return payload, state, m.Config, byte(i), nil
-			}
+	//offers differ in keys and ephemerals, one failing says nothing about the next
+	var failedIK *HandshakeMessage
+	for _, m := range selector.Select(messages, remote) {
+		state, payload, cfg, err := getState(m, keys, parsedPrologue, random)
+		if err == nil {
+			return payload, state, cfg, m.Index, nil
 		}
-	} else {
-		m := messages[prefferedIndex]
-		if state, payload, err := getState(m, s, parsedPrologue, random); err != nil {
-			return nil, nil, nil, 0, err
-		} else {
-			return payload, state, m.Config, byte(prefferedIndex), nil
+		if _, ok := r.fallbacks[m.Config.NameKey]; ok && failedIK == nil && len(keys.static(m.Config.DH).Public) > 0 {
+			failedIK = m
 		}
+	}
 
+	//no offer could be read, answer the first IK one with XXfallback
+	if m := failedIK; m != nil {
+		fallback := r.fallbacks[m.Config.NameKey]
+		state, err := getFallbackState(fallback, m, keys.static(fallback.DH), parsedPrologue, random)
+		if err != nil {
+			return nil, nil, nil, 0, err
+		}
+		return nil, state, fallback, m.Index, nil
 	}
-	err = errors.New("no supported protocols found")
+	err = errNoSupportedProtocols
 	return
 }
 
-func getState(m *HandshakeMessage, s noise.DHKey, parsedPrologue []byte, random io.Reader) (*noise.HandshakeState, []byte, error) {
+// getState reads the initiator's message m. The returned config is m.Config,
+// or its copy holding the ML-KEM state for hybrid suites
+func getState(m *HandshakeMessage, keys *ResponderKeys, parsedPrologue []byte, random io.Reader) (*noise.HandshakeState, []byte, *HandshakeConfig, error) {
+	msg := m.Message
+	cfg := m.Config.withKEM(nil)
+	s := keys.static(cfg.DH)
+	if cfg.responderStatic() && len(s.Public) == 0 {
+		return nil, nil, nil, errors.New("no static key for " + cfg.DH.DHName())
+	}
+	var psk []byte
+	if cfg.PSK {
+		if keys.PSKLookup == nil {
+			return nil, nil, nil, errors.New("pre-shared keys are not supported")
+		}
+		var identity []byte
+		var err error
+		if msg, identity, err = readField(msg, MessageTypePSKIdentity); err != nil {
+			return nil, nil, nil, err
+		}
+		if psk, err = keys.PSKLookup(identity); err != nil {
+			return nil, nil, nil, err
+		}
+		if len(psk) != pskSize {
+			return nil, nil, nil, errors.New("pre-shared key must be 32 bytes")
+		}
+	}
+
+	if len(cfg.Pattern.InitiatorPreMessages) == 0 {
+		state, payload, err := readFirstMessage(cfg, msg, s, nil, psk, parsedPrologue, random)
+		return state, payload, cfg, err
+	}
+
+	//KK: try every pre-provisioned initiator key
+	for _, rs := range keys.ClientKeys {
+		if len(rs) != cfg.DH.DHLen() {
+			continue
+		}
+		if state, payload, err := readFirstMessage(cfg, msg, s, rs, psk, parsedPrologue, random); err == nil {
+			return state, payload, cfg, nil
+		}
+	}
+	return nil, nil, nil, errors.New("unknown initiator static key")
+}
+
+func readFirstMessage(cfg *HandshakeConfig, msg []byte, s noise.DHKey, rs []byte, psk []byte, parsedPrologue []byte, random io.Reader) (*noise.HandshakeState, []byte, error) {
 	state := noise.NewHandshakeState(noise.Config{
 		StaticKeypair: s,
-		Pattern:       m.Config.Pattern,
-		CipherSuite:   noise.NewCipherSuite(m.Config.DH, m.Config.Cipher, m.Config.Hash),
+		Pattern:       cfg.Pattern,
+		CipherSuite:   noise.NewCipherSuite(cfg.DH, cfg.Cipher, cfg.Hash),
+		PeerStatic:    rs,
 		Prologue:      parsedPrologue,
 		Random:        random,
+
+		PresharedKey:          psk,
+		PresharedKeyPlacement: cfg.PSKPlacement,
 	})
 
-	payload, _, _, err := state.ReadMessage(nil, m.Message)
-	return state, payload, err
+	payload, _, _, err := state.ReadMessage(nil, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h := cfg.kem(); h != nil {
+		//encapsulate before the answer is written, its DH outputs include the KEM secret
+		if payload, err = h.encapsulate(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	return state, payload, nil
+}
+
+// readField strips the field of msgType in front of msg, such as the psk identity
+func readField(msg []byte, msgType uint16) (rest []byte, data []byte, err error) {
+	rest, field, err := readData(msg, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(field) < uint16Size || binary.BigEndian.Uint16(field) != msgType {
+		return nil, nil, errors.Errorf("field of type %d expected", msgType)
+	}
+	return rest, field[uint16Size:], nil
+}
+
+// getFallbackState prepares the responder of a failed IK handshake to initiate XXfallback.
+// The initiator's ephemeral key from the IK message becomes a pre-message.
+func getFallbackState(cfg *HandshakeConfig, m *HandshakeMessage, s noise.DHKey, parsedPrologue []byte, random io.Reader) (*noise.HandshakeState, error) {
+	if len(s.Public) == 0 {
+		return nil, errors.New("no static key for " + cfg.DH.DHName())
+	}
+	if len(m.Message) < cfg.DH.DHLen() {
+		return nil, errors.New("message is too small")
+	}
+	return noise.NewHandshakeState(noise.Config{
+		StaticKeypair: s,
+		Initiator:     true,
+		Pattern:       cfg.Pattern,
+		CipherSuite:   noise.NewCipherSuite(cfg.DH, cfg.Cipher, cfg.Hash),
+		PeerEphemeral: m.Message[:cfg.DH.DHLen()],
+		Prologue:      parsedPrologue,
+		Random:        random,
+	}), nil
+}
+
+// newFallbackState prepares the initiator of a failed IK handshake to respond to XXfallback,
+// reusing the ephemeral key it sent in the IK message.
+func newFallbackState(cfg *HandshakeConfig, s noise.DHKey, e noise.DHKey, prologue []byte) *noise.HandshakeState {
+	return noise.NewHandshakeState(noise.Config{
+		StaticKeypair:    s,
+		EphemeralKeypair: e,
+		Pattern:          cfg.Pattern,
+		CipherSuite:      noise.NewCipherSuite(cfg.DH, cfg.Cipher, cfg.Hash),
+		Prologue:         prologue,
+	})
 }
 
 func readData(data []byte, sizeBytes int) (rest []byte, msg []byte, err error) {
@@ -18,13 +18,20 @@ func TestHandshake(t *testing.T) {
 	payload := make([]byte, 500)
 	rand.Read(payload)
 
-	hm, _, istates, err := ComposeInitiatorHandshakeMessages(ki, nil, payload, nil)
+	r := defaultRegistry.restrict(nil, []string{"25519+MLKEM768_AESGCM_SHA256", "25519_AESGCM_SHA256"})
+	keys := r.staticKeys(ki, nil)
+	hm, _, istates, iconfigs, err := composeInitiatorHandshakeMessages(r.offeredConfigs(r.offeredPatterns(true, nil, false, false), keys, nil), keys, nil, nil, nil, payload, nil)
 	assert.NoError(t, err)
 
-	_, rstate, _, index, err := ParseHandshake(ks, hm, -1, nil)
+	_, rstate, cfg, index, err := ParseHandshake(&ResponderKeys{Static: ks}, hm, ServerPreference, nil, nil)
 	assert.NoError(t, err)
 	//assert.Equal(t, payload, parsedPayload)
 
+	//the server prefers the hybrid suite the client opted in to, hand its ML-KEM ciphertext over to the client
+	assert.NotNil(t, cfg.kem())
+	_, err = iconfigs[index].kem().decapsulate(appendField(nil, cfg.kem().ct, MessageTypeKEMCiphertext))
+	assert.NoError(t, err)
+
 	msg := make([]byte, 10*1024)
 	rand.Read(msg)
 	buf := make([]byte, 10*1024+16)
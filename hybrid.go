@@ -0,0 +1,79 @@
+package noisesocket
+
+import (
+	"crypto/mlkem"
+	"io"
+
+	"github.com/flynn/noise"
+	"github.com/pkg/errors"
+)
+
+// DH25519MLKEM768 is X25519 combined with ML-KEM-768. The initiator sends an ML-KEM
+// encapsulation key in its first message, the responder answers with a ciphertext.
+// From then on the KEM shared secret is appended to every DH output, so the transport
+// keys depend on both exchanges. Keys are Curve25519 keys.
+var DH25519MLKEM768 noise.DHFunc = &hybridDH{}
+
+// hybridDH holds the ML-KEM state of a single handshake.
+// The registered DH25519MLKEM768 is only a template, see HandshakeConfig.withKEM
+type hybridDH struct {
+	dk     *mlkem.DecapsulationKey768 // initiator side
+	ct     []byte                     // responder side, sent to the initiator
+	secret []byte                     // KEM shared secret, nil until the ciphertext is processed
+}
+
+func (h *hybridDH) GenerateKeypair(rng io.Reader) noise.DHKey {
+	return noise.DH25519.GenerateKeypair(rng)
+}
+
+func (h *hybridDH) DH(privkey, pubkey []byte) []byte {
+	return append(noise.DH25519.DH(privkey, pubkey), h.secret...)
+}
+
+func (h *hybridDH) DHLen() int     { return noise.DH25519.DHLen() }
+func (h *hybridDH) DHName() string { return "25519+MLKEM768" }
+
+// encapsulate reads the initiator's encapsulation key in front of payload
+// and derives the shared secret. It returns the rest of the payload
+func (h *hybridDH) encapsulate(payload []byte) ([]byte, error) {
+	rest, ek, err := readField(payload, MessageTypeKEMKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := mlkem.NewEncapsulationKey768(ek)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid ML-KEM encapsulation key")
+	}
+	h.secret, h.ct = key.Encapsulate()
+	return rest, nil
+}
+
+// decapsulate reads the responder's ciphertext in front of msg
+// and derives the shared secret. It returns the rest of the message
+func (h *hybridDH) decapsulate(msg []byte) ([]byte, error) {
+	rest, ct, err := readField(msg, MessageTypeKEMCiphertext)
+	if err != nil {
+		return nil, err
+	}
+	if h.secret, err = h.dk.Decapsulate(ct); err != nil {
+		return nil, errors.Wrap(err, "invalid ML-KEM ciphertext")
+	}
+	return rest, nil
+}
+
+// kem returns the hybrid DH state of the handshake, nil for classic suites
+func (c *HandshakeConfig) kem() *hybridDH {
+	h, _ := c.DH.(*hybridDH)
+	return h
+}
+
+// withKEM returns a copy of c with its own hybrid DH state if c is a hybrid suite, c otherwise.
+// dk is the initiator's decapsulation key, nil on the responder side
+func (c *HandshakeConfig) withKEM(dk *mlkem.DecapsulationKey768) *HandshakeConfig {
+	if c.kem() == nil {
+		return c
+	}
+	cfg := *c
+	cfg.DH = &hybridDH{dk: dk}
+	return &cfg
+}
@@ -0,0 +1,122 @@
+package noisesocket
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrPeerTimeout is returned by Read once Config.IdleTimeout has closed a connection
+// whose peer went silent.
+var ErrPeerTimeout = errors.New("noisesocket: peer idle timeout")
+
+var errInvalidKeepAlive = errors.New("noisesocket: KeepAlive must not be negative and IdleTimeout must be 0 or at least 2ns")
+
+// startKeepAlive starts pinging the peer and watching for silence, once the handshake is done
+func (c *Conn) startKeepAlive() {
+	c.epoch = time.Now()
+	atomic.StoreInt64(&c.lastRecv, 0)
+
+	tick := c.keepAlive
+	if half := c.idleTimeout / 2; half > 0 && (tick == 0 || half < tick) {
+		tick = half
+	}
+	go c.keepAliveLoop(tick)
+}
+
+// keepAliveLoop runs until the connection is closed or a ping cannot be sent
+func (c *Conn) keepAliveLoop(tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	var lastPing time.Duration
+	for range ticker.C {
+		if atomic.LoadInt32(&c.activeCall)&1 != 0 {
+			return
+		}
+
+		now := time.Since(c.epoch)
+		if c.idleTimeout > 0 && atomic.LoadInt32(&c.reading) == 1 &&
+			now-time.Duration(atomic.LoadInt64(&c.lastRecv)) >= c.idleTimeout {
+			atomic.StoreInt32(&c.peerTimedOut, 1)
+			c.conn.Close()
+			return
+		}
+
+		if c.keepAlive > 0 && now-lastPing >= c.keepAlive {
+			ping := make([]byte, 8)
+			binary.BigEndian.PutUint64(ping, uint64(now))
+			if err := c.writeRecordField(MessageTypePing, ping); err != nil {
+				return
+			}
+			lastPing = now
+		}
+	}
+}
+
+// RTT returns the smoothed round-trip time measured by the keepalive pings,
+// 0 until the first pong arrives. See Config.KeepAlive.
+func (c *Conn) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&c.srtt))
+}
+
+// handlePing echoes the ping. A blocked writer must not stop the reader, so pongs are sent
+// by a goroutine of their own. A ping arriving before its pong went out replaces it,
+// so that at most one pong is pending
+func (c *Conn) handlePing(data []byte) error {
+	c.pongMutex.Lock()
+	c.pong = append([]byte{}, data...)
+	start := !c.pongSending
+	c.pongSending = true
+	c.pongMutex.Unlock()
+
+	if start {
+		go c.sendPongs()
+	}
+	return nil
+}
+
+// sendPongs sends the pending pong until there is none left
+func (c *Conn) sendPongs() {
+	for {
+		c.pongMutex.Lock()
+		pong := c.pong
+		c.pong = nil
+		if pong == nil {
+			c.pongSending = false
+			c.pongMutex.Unlock()
+			return
+		}
+		c.pongMutex.Unlock()
+
+		if err := c.writeRecordField(MessageTypePong, pong); err != nil {
+			c.pongMutex.Lock()
+			c.pong = nil //a broken connection shows up in the next call
+			c.pongSending = false
+			c.pongMutex.Unlock()
+			return
+		}
+	}
+}
+
+// handlePong adds the round-trip time of one of our pings to the average, as in RFC 6298
+func (c *Conn) handlePong(data []byte) error {
+	if len(data) != 8 {
+		return errors.New("noisesocket: invalid pong")
+	}
+	sample := time.Since(c.epoch) - time.Duration(binary.BigEndian.Uint64(data))
+	if sample < 0 || c.epoch.IsZero() {
+		return nil
+	}
+
+	srtt := time.Duration(atomic.LoadInt64(&c.srtt))
+	if srtt == 0 {
+		srtt = sample
+	} else {
+		srtt += (sample - srtt) / 8
+	}
+	atomic.StoreInt64(&c.srtt, int64(srtt))
+	return nil
+}
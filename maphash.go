@@ -23,6 +23,8 @@ func generateHashKey() (uint64, uint64) {
 	return binary.BigEndian.Uint64(key), binary.BigEndian.Uint64(key[8:])
 }
 
+// HashKey hashes a protocol name with a per-process random key, so keys must not be
+// stored or sent. ParseProtocolName builds configs of names that are not registered.
 func HashKey(data []byte) uint64 {
 	return siphash.Hash(k0, k1, data)
 }
@@ -0,0 +1,123 @@
+package noisesocket
+
+import (
+	"github.com/pkg/errors"
+)
+
+// DefaultMaxMessageSize limits the messages of WriteMessage and ReadMessage
+// if Config.MaxMessageSize is not set.
+const DefaultMaxMessageSize = 1 << 20
+
+// maxQueuedMessages is how many times the maximum message size the unread messages
+// may take, a peer must not fill memory while the application only calls Read
+const maxQueuedMessages = 4
+
+var (
+	errMessageTooLarge = errors.New("noisesocket: message exceeds the maximum message size")
+	errMessageQueue    = errors.New("noisesocket: too many unread messages")
+)
+
+// WriteMessage sends msg as a single message the peer reads with ReadMessage.
+// Messages larger than a packet are fragmented. Messages do not mix with the byte stream
+// of Write and Read, but keep their order relative to each other.
+func (c *Conn) WriteMessage(msg []byte) error {
+	if len(msg) > c.maxMessageSize() {
+		return errMessageTooLarge
+	}
+	if err := c.beginWrite(); err != nil {
+		return err
+	}
+	defer c.endWrite()
+
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	if c.cover != nil {
+		_, err := c.queueCover(msg, MessageTypeMessage)
+		return err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	if err := c.out.err; err != nil {
+		return err
+	}
+
+	for {
+		if err := c.rekeyIfNeededLocked(); err != nil {
+			return c.out.setErrorLocked(err)
+		}
+
+		m := int(c.maxPayloadSizeForWrite(nil))
+		msgType := uint16(MessageTypeMessageFragment)
+		if len(msg) <= m {
+			m = len(msg)
+			msgType = MessageTypeMessage
+		}
+
+		if err := c.writeFieldLocked(msg[:m], msgType); err != nil {
+			return c.out.setErrorLocked(err)
+		}
+		msg = msg[m:]
+
+		if msgType == MessageTypeMessage {
+			return nil
+		}
+	}
+}
+
+// ReadMessage reads the next message sent with WriteMessage.
+// Data written with Write stays buffered for Read.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	if err := c.Handshake(); err != nil {
+		return nil, err
+	}
+
+	c.in.Lock()
+	defer c.in.Unlock()
+
+	for len(c.messages) == 0 {
+		if err := c.in.err; err != nil {
+			return nil, err
+		}
+		if err := c.readPacket(); err != nil && len(c.messages) == 0 {
+			return nil, err
+		}
+	}
+
+	msg := c.messages[0]
+	c.messages[0] = nil
+	c.messages = c.messages[1:]
+	c.queuedMessages -= len(msg) + msgHeaderSize
+	return msg, nil
+}
+
+func (c *Conn) maxMessageSize() int {
+	if c.maxMessage == 0 {
+		return DefaultMaxMessageSize
+	}
+	return c.maxMessage
+}
+
+// handleFragment buffers a fragment of a message
+func (c *Conn) handleFragment(data []byte) error {
+	if len(c.fragments)+len(data) > c.maxMessageSize() {
+		return errMessageTooLarge
+	}
+	if c.queuedMessages+len(c.fragments)+len(data)+msgHeaderSize > maxQueuedMessages*c.maxMessageSize() {
+		return errMessageQueue
+	}
+	c.fragments = append(c.fragments, data...)
+	return nil
+}
+
+// handleMessage completes a message and queues it for ReadMessage
+func (c *Conn) handleMessage(data []byte) error {
+	if err := c.handleFragment(data); err != nil {
+		return err
+	}
+	c.messages = append(c.messages, append([]byte{}, c.fragments...))
+	c.queuedMessages += len(c.fragments) + msgHeaderSize
+	c.fragments = c.fragments[:0]
+	return nil
+}
@@ -0,0 +1,94 @@
+package noisesocket
+
+import (
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessages(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	client, server := connPair(&Config{StaticKey: ki}, &Config{StaticKey: ks, MaxPacketSize: 1000})
+	defer client.Close()
+	defer server.Close()
+
+	big := make([]byte, 200000)
+	rand.Read(big)
+	msgs := [][]byte{[]byte("hello"), {}, big, []byte("bye")}
+
+	go func() {
+		for i, msg := range msgs {
+			assert.NoError(t, client.WriteMessage(msg))
+			if i == 1 {
+				client.Write([]byte("stream"))
+			}
+		}
+	}()
+
+	for _, msg := range msgs {
+		res, err := server.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, msg, res)
+	}
+
+	buf := make([]byte, 6)
+	_, err := io.ReadFull(server, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("stream"), buf)
+
+	assert.Equal(t, errMessageTooLarge, client.WriteMessage(make([]byte, DefaultMaxMessageSize+1)))
+}
+
+func TestMaxMessageSize(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	client, server := connPair(&Config{StaticKey: ki}, &Config{StaticKey: ks, MaxMessageSize: 100000})
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		client.WriteMessage(make([]byte, 100000))
+		client.WriteMessage(make([]byte, 100001))
+	}()
+
+	msg, err := server.ReadMessage()
+	assert.NoError(t, err)
+	assert.Len(t, msg, 100000)
+
+	_, err = server.ReadMessage()
+	assert.Equal(t, errMessageTooLarge, err)
+}
+
+func TestMessageQueue(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	client, server := connPair(&Config{StaticKey: ki}, &Config{StaticKey: ks, MaxMessageSize: 1000})
+	defer client.Close()
+	defer server.Close()
+
+	// messages nobody reads pile up until the queue is full
+	go func() {
+		for i := 0; i < 5; i++ {
+			client.WriteMessage(make([]byte, 1000))
+		}
+		client.Write([]byte("x"))
+	}()
+
+	_, err := server.Read(make([]byte, 1))
+	assert.Equal(t, errMessageQueue, err)
+
+	// writes fail once the connection is closed
+	assert.NoError(t, client.Close())
+	assert.Equal(t, errClosed, client.WriteMessage([]byte("late")))
+	assert.Equal(t, errClosed, client.WriteField(MinFieldType, []byte("late")))
+}
@@ -0,0 +1,109 @@
+// Package noisegrpc implements gRPC transport credentials on top of NoiseSocket.
+//
+// Interceptors can authorize calls by Noise identity with AuthInfoFromContext.
+package noisegrpc
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"gopkg.in/noisesocket.v0"
+)
+
+// AuthType is the value returned by AuthInfo.AuthType.
+const AuthType = "noisesocket"
+
+// AuthInfo contains the authentication information of a NoiseSocket connection.
+// It implements credentials.AuthInfo.
+type AuthInfo struct {
+	credentials.CommonAuthInfo
+
+	// PeerKey is the verified peer static key, nil for anonymous peers.
+	PeerKey []byte
+	// Protocol is the negotiated Noise protocol name.
+	Protocol string
+	// State is the full connection state.
+	State noisesocket.ConnectionState
+}
+
+// AuthType returns the type of AuthInfo as a string.
+func (a AuthInfo) AuthType() string {
+	return AuthType
+}
+
+// ChannelBinding returns the handshake hash of the connection.
+func (a AuthInfo) ChannelBinding() []byte {
+	return a.State.HandshakeHash
+}
+
+// AuthInfoFromContext returns the AuthInfo of the peer a call came from.
+func AuthInfoFromContext(ctx context.Context) (AuthInfo, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return AuthInfo{}, false
+	}
+	info, ok := p.AuthInfo.(AuthInfo)
+	return info, ok
+}
+
+type noiseCredentials struct {
+	config *noisesocket.Config
+}
+
+// NewCredentials returns TransportCredentials which secure gRPC
+// connections with NoiseSocket handshakes configured by config.
+// The same credentials may be used by clients and servers.
+// The config cannot be nil.
+func NewCredentials(config *noisesocket.Config) credentials.TransportCredentials {
+	return &noiseCredentials{config: config}
+}
+
+// ClientHandshake runs the client side of the NoiseSocket handshake on rawConn.
+func (c *noiseCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn := noisesocket.Client(rawConn, c.config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, newAuthInfo(conn), nil
+}
+
+// ServerHandshake runs the server side of the NoiseSocket handshake on rawConn.
+func (c *noiseCredentials) ServerHandshake(rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn := noisesocket.Server(rawConn, c.config)
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, newAuthInfo(conn), nil
+}
+
+// Info provides the ProtocolInfo of these credentials.
+func (c *noiseCredentials) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{
+		SecurityProtocol: AuthType,
+	}
+}
+
+// Clone makes a copy of these credentials.
+func (c *noiseCredentials) Clone() credentials.TransportCredentials {
+	return &noiseCredentials{config: c.config}
+}
+
+// OverrideServerName is not supported, NoiseSocket peers are identified by static keys.
+func (c *noiseCredentials) OverrideServerName(string) error {
+	return errors.New("noisegrpc: server name override is not supported")
+}
+
+func newAuthInfo(conn *noisesocket.Conn) AuthInfo {
+	state := conn.ConnectionState()
+	return AuthInfo{
+		CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+		PeerKey:        state.PeerStatic,
+		Protocol:       state.Protocol,
+		State:          state,
+	}
+}
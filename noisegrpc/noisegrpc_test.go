@@ -0,0 +1,91 @@
+package noisegrpc
+
+import (
+	"context"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"gopkg.in/noisesocket.v0"
+)
+
+func TestCredentials(t *testing.T) {
+
+	serverKeys := noise.DH25519.GenerateKeypair(rand.Reader)
+	clientKeys := noise.DH25519.GenerateKeypair(rand.Reader)
+	stranger := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	lis := bufconn.Listen(1 << 20)
+
+	// only the client key is authorized
+	authorize := func(ctx context.Context) error {
+		info, ok := AuthInfoFromContext(ctx)
+		if !ok || string(info.PeerKey) != string(clientKeys.Public) {
+			return status.Error(codes.PermissionDenied, "unknown peer")
+		}
+		if len(info.ChannelBinding()) == 0 || info.Protocol == "" {
+			return status.Error(codes.Internal, "no connection state")
+		}
+		return nil
+	}
+
+	srv := grpc.NewServer(
+		grpc.Creds(NewCredentials(&noisesocket.Config{StaticKey: serverKeys})),
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := authorize(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := authorize(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(lis)
+	defer srv.Stop()
+
+	dial := func(keys noise.DHKey) *grpc.ClientConn {
+		conn, err := grpc.NewClient("passthrough:///bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return lis.DialContext(ctx)
+			}),
+			grpc.WithTransportCredentials(NewCredentials(&noisesocket.Config{StaticKey: keys, PeerKey: serverKeys.Public})),
+		)
+		assert.NoError(t, err)
+		return conn
+	}
+
+	conn := dial(clientKeys)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	// unary
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	// streaming
+	stream, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+	resp, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	// unauthorized peer
+	other := dial(stranger)
+	defer other.Close()
+	_, err = healthpb.NewHealthClient(other).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,176 @@
+// Package noisehttp runs HTTP over NoiseSocket connections.
+//
+// Clients use Transport as an http.RoundTripper, servers use ServeNoise.
+// Handlers learn the verified peer identity with PeerFromContext.
+package noisehttp
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gopkg.in/noisesocket.v0"
+)
+
+var (
+	// ErrKeyMismatch is returned when a server presents a static key
+	// other than the one pinned for its address.
+	ErrKeyMismatch = errors.New("noisehttp: server key does not match the pinned key")
+
+	// ErrUnverifiedServer is returned when dialing an address without a pinned key
+	// while neither Config.VerifyCallback nor InsecureSkipVerify is set.
+	ErrUnverifiedServer = errors.New("noisehttp: no pinned key or verify callback for server")
+
+	// ErrPlaintext is returned for requests that are not https, they would bypass NoiseSocket.
+	ErrPlaintext = errors.New("noisehttp: only https URLs are sent over NoiseSocket")
+)
+
+// Transport is an http.RoundTripper which sends requests to https URLs
+// over NoiseSocket connections.
+type Transport struct {
+	// Config is a template for every dialed connection. Its PeerKey is
+	// replaced with the key pinned for the dialed address.
+	Config *noisesocket.Config
+
+	// ServerKeys maps "host:port" addresses to pinned server static keys.
+	// If an address has a pinned key, the handshake fails with
+	// ErrKeyMismatch unless the server proves possession of that key.
+	// Addresses without a pinned key are verified by Config.VerifyCallback,
+	// dialing them fails with ErrUnverifiedServer if there is none.
+	ServerKeys map[string][]byte
+
+	// InsecureSkipVerify makes addresses without a pinned key or VerifyCallback
+	// accept any server key. Such connections are not authenticated,
+	// it should only be used for testing.
+	InsecureSkipVerify bool
+
+	// Base, if not nil, is used as a template for the underlying
+	// http.Transport. Its dialers are overridden and its Proxy is not used.
+	Base *http.Transport
+
+	once      sync.Once
+	transport *http.Transport
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.once.Do(t.init)
+	if req.URL.Scheme != "https" {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, ErrPlaintext
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// CloseIdleConnections closes idle connections of the underlying transport.
+func (t *Transport) CloseIdleConnections() {
+	t.once.Do(t.init)
+	t.transport.CloseIdleConnections()
+}
+
+func (t *Transport) init() {
+	if t.Base != nil {
+		t.transport = t.Base.Clone()
+	} else {
+		t.transport = &http.Transport{}
+	}
+	t.transport.DialTLSContext = t.DialContext
+	t.transport.DialContext = func(context.Context, string, string) (net.Conn, error) {
+		return nil, ErrPlaintext
+	}
+	t.transport.Proxy = nil
+}
+
+// DialContext connects to addr and runs the NoiseSocket handshake,
+// verifying the server key pinned for addr or with Config.VerifyCallback.
+func (t *Transport) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if t.Config == nil {
+		return nil, errors.New("noisehttp: transport config is nil")
+	}
+	cfg := *t.Config
+	cfg.PeerKey = nil
+
+	if pinned, ok := t.ServerKeys[addr]; ok {
+		cfg.PeerKey = pinned
+		verify := cfg.VerifyCallback
+		cfg.VerifyCallback = func(publicKey []byte, fields []*noisesocket.Field) error {
+			if subtle.ConstantTimeCompare(publicKey, pinned) != 1 {
+				return ErrKeyMismatch
+			}
+			if verify != nil {
+				return verify(publicKey, fields)
+			}
+			return nil
+		}
+	} else if cfg.VerifyCallback == nil && !t.InsecureSkipVerify {
+		return nil, ErrUnverifiedServer
+	}
+
+	conn, err := noisesocket.DialContext(ctx, network, addr, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Peer describes the remote side of a NoiseSocket connection.
+type Peer struct {
+	PublicKey     []byte                      // verified peer static key, nil for anonymous peers
+	HandshakeHash []byte                      // handshake hash of the connection
+	Fields        []*noisesocket.Field        // fields the peer sent in its handshake payloads
+	State         noisesocket.ConnectionState // full connection state
+}
+
+type connContextKey struct{}
+
+// ConnContext stores c in ctx if it is a NoiseSocket connection.
+// It is suitable for http.Server.ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if conn, ok := c.(*noisesocket.Conn); ok {
+		return context.WithValue(ctx, connContextKey{}, conn)
+	}
+	return ctx
+}
+
+// PeerFromContext returns the peer of the NoiseSocket connection
+// a request was received on. ok is false if the request did not
+// arrive over NoiseSocket.
+func PeerFromContext(ctx context.Context) (peer *Peer, ok bool) {
+	conn, ok := ctx.Value(connContextKey{}).(*noisesocket.Conn)
+	if !ok {
+		return nil, false
+	}
+	state := conn.ConnectionState()
+	if !state.HandshakeComplete {
+		return nil, false
+	}
+	return &Peer{
+		PublicKey:     state.PeerStatic,
+		HandshakeHash: state.HandshakeHash,
+		Fields:        state.PeerFields,
+		State:         state,
+	}, true
+}
+
+// ServeNoise accepts connections on l, wraps them with noisesocket.Server
+// and serves HTTP requests on them using srv.
+// srv.ConnContext is chained so that handlers can use PeerFromContext.
+// The config cannot be nil.
+func ServeNoise(srv *http.Server, l net.Listener, config *noisesocket.Config) error {
+	if config == nil {
+		return errors.New("noisehttp: config is nil")
+	}
+	connContext := srv.ConnContext
+	srv.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		return ConnContext(ctx, c)
+	}
+	return srv.Serve(noisesocket.NewListener(l, config))
+}
@@ -0,0 +1,87 @@
+package noisehttp
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/noisesocket.v0"
+)
+
+func startServer(t *testing.T, serverKeys noise.DHKey) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			peer, ok := PeerFromContext(r.Context())
+			if !ok {
+				http.Error(w, "no peer", http.StatusInternalServerError)
+				return
+			}
+			w.Write(peer.PublicKey)
+		}),
+	}
+	go ServeNoise(srv, l, &noisesocket.Config{StaticKey: serverKeys})
+	t.Cleanup(func() { srv.Close() })
+
+	return l.Addr().String()
+}
+
+func TestTransport(t *testing.T) {
+
+	serverKeys := noise.DH25519.GenerateKeypair(rand.Reader)
+	clientKeys := noise.DH25519.GenerateKeypair(rand.Reader)
+	addr := startServer(t, serverKeys)
+
+	client := &http.Client{Transport: &Transport{
+		Config:     &noisesocket.Config{StaticKey: clientKeys},
+		ServerKeys: map[string][]byte{addr: serverKeys.Public},
+	}}
+
+	resp, err := client.Get("https://" + addr + "/")
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, clientKeys.Public, body)
+}
+
+func TestTransportKeyMismatch(t *testing.T) {
+
+	serverKeys := noise.DH25519.GenerateKeypair(rand.Reader)
+	otherKeys := noise.DH25519.GenerateKeypair(rand.Reader)
+	addr := startServer(t, serverKeys)
+
+	client := &http.Client{Transport: &Transport{
+		Config:     &noisesocket.Config{StaticKey: noise.DH25519.GenerateKeypair(rand.Reader)},
+		ServerKeys: map[string][]byte{addr: otherKeys.Public},
+	}}
+
+	_, err := client.Get("https://" + addr + "/")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrKeyMismatch.Error())
+}
+
+func TestTransportFailsClosed(t *testing.T) {
+
+	serverKeys := noise.DH25519.GenerateKeypair(rand.Reader)
+	addr := startServer(t, serverKeys)
+
+	transport := &Transport{Config: &noisesocket.Config{StaticKey: noise.DH25519.GenerateKeypair(rand.Reader)}}
+	client := &http.Client{Transport: transport}
+
+	_, err := client.Get("https://" + addr + "/")
+	assert.ErrorIs(t, err, ErrUnverifiedServer)
+	_, err = client.Get("http://" + addr + "/")
+	assert.ErrorIs(t, err, ErrPlaintext)
+
+	transport.InsecureSkipVerify = true
+	resp, err := client.Get("https://" + addr + "/")
+	assert.NoError(t, err)
+	resp.Body.Close()
+}
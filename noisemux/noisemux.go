@@ -0,0 +1,324 @@
+// Package noisemux runs many bidirectional streams over a single NoiseSocket connection,
+// so that logical channels to the same peer share one handshake.
+//
+// Frames are NoiseSocket fields of type FieldType and travel in the encrypted record layer.
+// Either side opens streams with Session.Open, the peer gets them from Session.Accept.
+// Every stream has its own flow control window.
+package noisemux
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/noisesocket.v0"
+)
+
+// FieldType is the NoiseSocket field type of noisemux frames.
+const FieldType = 0x6D78
+
+// DefaultWindow is the receive window of a stream if Config.Window is not set.
+const DefaultWindow = 256 << 10
+
+// DefaultAcceptBacklog is the number of streams waiting for Accept if Config.AcceptBacklog is not set.
+const DefaultAcceptBacklog = 256
+
+// DefaultCloseTimeout is how long a closed stream waits for the peer to close it
+// if Config.CloseTimeout is not set.
+const DefaultCloseTimeout = 30 * time.Second
+
+// a frame is the kind, the stream id and the payload
+const headerSize = 5
+
+const (
+	frameOpen   byte = iota // a new stream
+	frameData               // stream data
+	frameWindow             // the receiver read data, the payload is the 4 byte window increment
+	frameClose              // the sender will not write any more
+	frameReset              // the stream is aborted in both directions
+)
+
+var (
+	// ErrSessionClosed is returned by the streams and Accept of a closed session.
+	ErrSessionClosed = errors.New("noisemux: session closed")
+	// ErrStreamClosed is returned when using a stream after Close or CloseWrite.
+	ErrStreamClosed = errors.New("noisemux: stream closed")
+	// ErrStreamReset is returned when using a stream that was reset by either side.
+	ErrStreamReset = errors.New("noisemux: stream reset")
+
+	errInvalidFrame = errors.New("noisemux: invalid frame")
+	errControlQueue = errors.New("noisemux: peer does not read control frames")
+)
+
+// Config tunes a Session. A nil Config uses the defaults.
+type Config struct {
+	// Window is the number of bytes the peer may send on a stream before it is read.
+	Window uint32
+
+	// AcceptBacklog is the number of streams opened by the peer that wait for Accept.
+	// Streams beyond it are reset.
+	AcceptBacklog int
+
+	// CloseTimeout is how long a stream closed with Close waits for the peer to close it
+	// as well before it is reset.
+	CloseTimeout time.Duration
+}
+
+// A Session multiplexes streams over a NoiseSocket connection. It is a net.Listener
+// accepting the streams the peer opens.
+type Session struct {
+	conn         *noisesocket.Conn
+	window       uint32
+	closeTimeout time.Duration
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32 // clients open odd streams, servers even ones
+	err     error
+
+	accept    chan *Stream
+	control   chan []byte // frames the reader sends, written by writeLoop
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Client runs the handshake of a client conn and returns its session.
+func Client(conn *noisesocket.Conn, config *Config) (*Session, error) {
+	return newSession(conn, config, 1)
+}
+
+// Server runs the handshake of a server conn and returns its session.
+func Server(conn *noisesocket.Conn, config *Config) (*Session, error) {
+	return newSession(conn, config, 2)
+}
+
+func newSession(conn *noisesocket.Conn, config *Config, firstID uint32) (*Session, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	s := &Session{
+		conn:         conn,
+		window:       config.Window,
+		closeTimeout: config.CloseTimeout,
+		streams:      make(map[uint32]*Stream),
+		nextID:       firstID,
+		closed:       make(chan struct{}),
+	}
+	if s.window == 0 {
+		s.window = DefaultWindow
+	}
+	if s.closeTimeout == 0 {
+		s.closeTimeout = DefaultCloseTimeout
+	}
+	backlog := config.AcceptBacklog
+	if backlog == 0 {
+		backlog = DefaultAcceptBacklog
+	}
+	s.accept = make(chan *Stream, backlog)
+	s.control = make(chan []byte, backlog)
+
+	conn.HandleField(FieldType, s.handleFrame)
+	go s.recvLoop()
+	go s.writeLoop()
+	return s, nil
+}
+
+// recvLoop keeps the connection reading, frames are processed by handleFrame
+func (s *Session) recvLoop() {
+	buf := make([]byte, 4096)
+	for {
+		if _, err := s.conn.Read(buf); err != nil { //data outside of streams is dropped
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+// writeLoop writes the frames queued by the reader, which must not block on writes
+func (s *Session) writeLoop() {
+	for {
+		select {
+		case frame := <-s.control:
+			if err := s.conn.WriteField(FieldType, frame); err != nil {
+				s.closeWithError(err)
+				return
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// Open opens a new stream to the peer. The returned net.Conn is a *Stream.
+func (s *Session) Open() (net.Conn, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	st := newStream(s, s.nextID)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, st.id, nil); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the next stream opened by the peer. The returned net.Conn is a *Stream.
+func (s *Session) Accept() (net.Conn, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.closed:
+		return nil, s.sessionErr()
+	}
+}
+
+// Addr returns the local address of the connection.
+func (s *Session) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close closes the connection and every stream.
+func (s *Session) Close() error {
+	s.closeWithError(ErrSessionClosed)
+	return s.conn.Close()
+}
+
+// Conn returns the underlying connection.
+func (s *Session) Conn() *noisesocket.Conn {
+	return s.conn
+}
+
+func (s *Session) closeWithError(err error) {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.closed)
+	})
+}
+
+func (s *Session) sessionErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+func (s *Session) writeFrame(kind byte, id uint32, payload []byte) error {
+	return s.conn.WriteField(FieldType, newFrame(kind, id, payload))
+}
+
+// queueFrame hands a frame to writeLoop. A peer that lets the queue fill up ends the session
+func (s *Session) queueFrame(kind byte, id uint32, payload []byte) error {
+	select {
+	case s.control <- newFrame(kind, id, payload):
+		return nil
+	default:
+		return errControlQueue
+	}
+}
+
+func newFrame(kind byte, id uint32, payload []byte) []byte {
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], id)
+	copy(frame[headerSize:], payload)
+	return frame
+}
+
+// maxData is the largest data frame payload that fits in a packet
+func (s *Session) maxData() int {
+	return s.conn.MaxFieldSize() - headerSize
+}
+
+// handleFrame processes a frame on the goroutine of recvLoop. It queues the frames it sends,
+// a writer blocked by the peer must not stop the reader. An error ends the session
+func (s *Session) handleFrame(_ *noisesocket.Conn, frame []byte) error {
+	if len(frame) < headerSize {
+		return errInvalidFrame
+	}
+	kind, id, payload := frame[0], binary.BigEndian.Uint32(frame[1:]), frame[headerSize:]
+
+	if kind == frameOpen {
+		return s.handleOpen(id)
+	}
+
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+	if st == nil { //frames in flight when the stream was reset
+		return nil
+	}
+
+	switch kind {
+	case frameData:
+		if !st.push(payload) && st.abort() { //the peer ignored the window
+			return s.queueFrame(frameReset, id, nil)
+		}
+	case frameWindow:
+		if len(payload) != 4 {
+			return errInvalidFrame
+		}
+		st.grow(binary.BigEndian.Uint32(payload))
+	case frameClose:
+		st.remoteClose()
+	case frameReset:
+		st.remoteReset()
+	default:
+		return errInvalidFrame
+	}
+	return nil
+}
+
+func (s *Session) handleOpen(id uint32) error {
+	s.mu.Lock()
+	if id%2 == s.nextID%2 || s.streams[id] != nil {
+		s.mu.Unlock()
+		return errInvalidFrame
+	}
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- st:
+		return nil
+	default:
+		s.remove(id)
+		return s.queueFrame(frameReset, id, nil)
+	}
+}
+
+// signal wakes a goroutine waiting on ch without blocking
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,196 @@
+package noisemux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/noisesocket.v0"
+)
+
+// sessionPair returns a client and a server session over loopback TCP
+func sessionPair(t *testing.T, config *Config) (*Session, *Session) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	s, err := l.Accept()
+	assert.NoError(t, err)
+
+	servers := make(chan *Session, 1)
+	go func() {
+		server, err := Server(noisesocket.Server(s, &noisesocket.Config{StaticKey: noise.DH25519.GenerateKeypair(rand.Reader)}), config)
+		assert.NoError(t, err)
+		servers <- server
+	}()
+
+	client, err := Client(noisesocket.Client(c, &noisesocket.Config{StaticKey: noise.DH25519.GenerateKeypair(rand.Reader)}), config)
+	assert.NoError(t, err)
+	server := <-servers
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestStreams(t *testing.T) {
+
+	// a small window makes writers wait for the readers
+	client, server := sessionPair(t, &Config{Window: 4096})
+
+	go func() {
+		for {
+			st, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(st, st)
+				st.Close()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			st, err := client.Open()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer st.Close()
+
+			msg := make([]byte, 100000)
+			rand.Read(msg)
+			go func() {
+				st.Write(msg)
+				st.(*Stream).CloseWrite()
+			}()
+
+			res, err := io.ReadAll(st)
+			assert.NoError(t, err)
+			assert.True(t, bytes.Equal(msg, res))
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServerOpen(t *testing.T) {
+
+	client, server := sessionPair(t, nil)
+
+	st, err := server.Open()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(2), st.(*Stream).ID())
+	_, err = st.Write([]byte("push"))
+	assert.NoError(t, err)
+
+	accepted, err := client.Accept()
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(accepted, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("push"), buf)
+	assert.Equal(t, client.Addr(), accepted.LocalAddr())
+}
+
+func TestReset(t *testing.T) {
+
+	client, server := sessionPair(t, nil)
+
+	st, err := client.Open()
+	assert.NoError(t, err)
+	_, err = st.Write([]byte("hello"))
+	assert.NoError(t, err)
+
+	accepted, err := server.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, accepted.(*Stream).Reset())
+
+	_, err = st.Read(make([]byte, 1))
+	assert.Equal(t, ErrStreamReset, err)
+	_, err = accepted.Write([]byte("late"))
+	assert.Equal(t, ErrStreamReset, err)
+}
+
+func TestCloseTimeout(t *testing.T) {
+
+	client, server := sessionPair(t, &Config{Window: 16, CloseTimeout: 50 * time.Millisecond})
+
+	// a peer ignoring the window gets the stream reset by the reader
+	st, err := client.Open()
+	assert.NoError(t, err)
+	accepted, err := server.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, client.writeFrame(frameData, st.(*Stream).ID(), make([]byte, 17)))
+	_, err = st.Read(make([]byte, 1))
+	assert.Equal(t, ErrStreamReset, err)
+	_, err = accepted.Read(make([]byte, 1))
+	assert.Equal(t, ErrStreamReset, err)
+
+	// a stream the peer does not close is reset after the timeout
+	st, err = client.Open()
+	assert.NoError(t, err)
+	accepted, err = server.Accept()
+	assert.NoError(t, err)
+	assert.NoError(t, st.Close())
+
+	_, err = accepted.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	time.Sleep(200 * time.Millisecond)
+	_, err = accepted.Write([]byte("late"))
+	assert.Equal(t, ErrStreamReset, err)
+
+	client.mu.Lock()
+	assert.Empty(t, client.streams)
+	client.mu.Unlock()
+	server.mu.Lock()
+	assert.Empty(t, server.streams)
+	server.mu.Unlock()
+}
+
+func TestDeadline(t *testing.T) {
+
+	client, _ := sessionPair(t, nil)
+
+	st, err := client.Open()
+	assert.NoError(t, err)
+
+	assert.NoError(t, st.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = st.Read(make([]byte, 1))
+	assert.Equal(t, os.ErrDeadlineExceeded, err)
+	assert.True(t, err.(net.Error).Timeout())
+}
+
+func TestSessionClose(t *testing.T) {
+
+	client, server := sessionPair(t, nil)
+
+	st, err := client.Open()
+	assert.NoError(t, err)
+	_, err = server.Accept()
+	assert.NoError(t, err)
+
+	assert.NoError(t, server.Close())
+
+	_, err = st.Read(make([]byte, 1))
+	assert.Error(t, err)
+	_, err = client.Accept()
+	assert.Error(t, err)
+	_, err = client.Open()
+	assert.Error(t, err)
+}
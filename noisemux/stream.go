@@ -0,0 +1,344 @@
+package noisemux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ net.Conn = (*Stream)(nil)
+
+// A Stream is a bidirectional byte stream of a Session. It implements net.Conn.
+type Stream struct {
+	session *Session
+	id      uint32
+
+	mu            sync.Mutex
+	buf           []byte // received data not read yet
+	recvWindow    uint32 // data the peer may still send
+	consumed      uint32 // data read since the last window update
+	sendWindow    uint32 // data we may still send
+	localClosed   bool   // Close or CloseWrite was called
+	readClosed    bool   // Close was called
+	remoteClosed  bool   // the peer will not write any more
+	err           error  // the stream was reset
+	readDeadline  time.Time
+	writeDeadline time.Time
+	expiry        *time.Timer // resets the stream if the peer does not close it after Close
+	readReady     chan struct{}
+	writeReady    chan struct{}
+
+	writeMu sync.Mutex // serializes writers waiting for the window
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{
+		session:    s,
+		id:         id,
+		recvWindow: s.window,
+		sendWindow: s.window,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream id, odd for streams opened by the client.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Read reads stream data. It returns io.EOF once the peer has closed the stream
+// and everything it wrote has been read.
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.buf) > 0 && !st.readClosed {
+			n := copy(b, st.buf)
+			st.buf = st.buf[n:]
+			if len(st.buf) == 0 {
+				st.buf = nil
+			}
+
+			//give the window back once half of it has been read
+			var update uint32
+			st.consumed += uint32(n)
+			if st.consumed >= st.session.window/2 && !st.remoteClosed {
+				update, st.consumed = st.consumed, 0
+				st.recvWindow += update
+			}
+			st.mu.Unlock()
+
+			if update > 0 {
+				inc := make([]byte, 4)
+				binary.BigEndian.PutUint32(inc, update)
+				st.session.writeFrame(frameWindow, st.id, inc) //a broken session shows up in the next call
+			}
+			return n, nil
+		}
+
+		err := st.readErrLocked()
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err != nil {
+			return 0, err
+		}
+		if err = st.wait(st.readReady, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) readErrLocked() error {
+	switch {
+	case st.err != nil:
+		return st.err
+	case st.readClosed:
+		return ErrStreamClosed
+	case st.remoteClosed:
+		return io.EOF
+	case st.session.isClosed():
+		return st.session.sessionErr()
+	}
+	return nil
+}
+
+// Write writes data to the stream, waiting for the peer to read if its window is full.
+func (st *Stream) Write(b []byte) (n int, err error) {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+
+	for len(b) > 0 {
+		st.mu.Lock()
+		if err := st.writeErrLocked(); err != nil {
+			st.mu.Unlock()
+			return n, err
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writeReady, deadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		m := len(b)
+		if m > int(st.sendWindow) {
+			m = int(st.sendWindow)
+		}
+		if max := st.session.maxData(); m > max {
+			m = max
+		}
+		st.sendWindow -= uint32(m)
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(frameData, st.id, b[:m]); err != nil {
+			return n, err
+		}
+		n += m
+		b = b[m:]
+	}
+	return n, nil
+}
+
+func (st *Stream) writeErrLocked() error {
+	switch {
+	case st.err != nil:
+		return st.err
+	case st.localClosed:
+		return ErrStreamClosed
+	case st.session.isClosed():
+		return st.session.sessionErr()
+	}
+	return nil
+}
+
+// wait blocks until ready is signalled, the deadline passes or the session closes
+func (st *Stream) wait(ready chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ready:
+	case <-st.session.closed:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// CloseWrite tells the peer that no more data follows, it reads io.EOF.
+// The stream can still be read.
+func (st *Stream) CloseWrite() error {
+	return st.close(false)
+}
+
+// Close closes the stream in both directions. The peer reads io.EOF,
+// data it sends afterwards is dropped. A peer that does not close the stream
+// within Config.CloseTimeout gets it reset.
+func (st *Stream) Close() error {
+	return st.close(true)
+}
+
+func (st *Stream) close(read bool) error {
+	st.mu.Lock()
+	if st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	if read && !st.readClosed {
+		st.readClosed = true
+		st.buf = nil
+		if !st.remoteClosed {
+			st.expiry = time.AfterFunc(st.session.closeTimeout, st.expire)
+		}
+	}
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	done := st.remoteClosed
+	st.mu.Unlock()
+	signal(st.readReady)
+	signal(st.writeReady)
+
+	err := st.session.writeFrame(frameClose, st.id, nil)
+	if done {
+		st.session.remove(st.id)
+	}
+	return err
+}
+
+// Reset aborts the stream in both directions. Pending and further calls on both sides
+// return ErrStreamReset.
+func (st *Stream) Reset() error {
+	if !st.abort() {
+		return nil
+	}
+	return st.session.writeFrame(frameReset, st.id, nil)
+}
+
+// abort fails the stream with ErrStreamReset and forgets it, the caller tells the peer.
+// It reports false if the stream had failed before
+func (st *Stream) abort() bool {
+	if !st.setErr(ErrStreamReset) {
+		return false
+	}
+	st.session.remove(st.id)
+	return true
+}
+
+// expire resets a stream closed with Close that the peer did not close in time
+func (st *Stream) expire() {
+	st.mu.Lock()
+	done := st.remoteClosed
+	st.mu.Unlock()
+	if !done {
+		st.Reset()
+	}
+}
+
+// push buffers data of the peer. It reports false if the data exceeds the window
+func (st *Stream) push(data []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if uint32(len(data)) > st.recvWindow || st.remoteClosed {
+		return false
+	}
+	if st.readClosed || st.err != nil {
+		return true
+	}
+	st.recvWindow -= uint32(len(data))
+	st.buf = append(st.buf, data...)
+	signal(st.readReady)
+	return true
+}
+
+// grow adds n to the send window
+func (st *Stream) grow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	signal(st.writeReady)
+}
+
+func (st *Stream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	if st.expiry != nil {
+		st.expiry.Stop()
+	}
+	st.mu.Unlock()
+	signal(st.readReady)
+	if done {
+		st.session.remove(st.id)
+	}
+}
+
+func (st *Stream) remoteReset() {
+	st.abort()
+}
+
+// setErr fails the stream, it reports false if it had failed before
+func (st *Stream) setErr(err error) bool {
+	st.mu.Lock()
+	if st.err != nil {
+		st.mu.Unlock()
+		return false
+	}
+	st.err = err
+	st.buf = nil
+	st.mu.Unlock()
+	signal(st.readReady)
+	signal(st.writeReady)
+	return true
+}
+
+// LocalAddr returns the local address of the connection.
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the connection.
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the stream.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for Read calls, pending ones included.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	signal(st.readReady)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write calls waiting for the window, pending ones included.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	signal(st.writeReady)
+	return nil
+}
@@ -1,71 +1,88 @@
 package noisesocket
 
 import (
+	"context"
 	"net"
 
-	"github.com/flynn/noise"
+	"github.com/pkg/errors"
 )
 
-// A listener implements a network listener (net.Listener) for TLS connections.
+// A listener implements a network listener (net.Listener) for NoiseSocket connections.
 type listener struct {
 	net.Listener
-	key               noise.DHKey
-	payload           []*Field
-	verifyCallback    VerifyCallbackFunc
-	handshakeStrategy int
-	maxPacketSize     uint16
+	config *Config
 }
 
-// Accept waits for and returns the next incoming TLS connection.
+// Accept waits for and returns the next incoming NoiseSocket connection.
 // The returned connection is of type *Conn.
 func (l *listener) Accept() (net.Conn, error) {
 	c, err := l.Listener.Accept()
 	if err != nil {
 		return nil, err
 	}
-	return &Conn{
-		conn:              c,
-		myKeys:            l.key,
-		padding:           128,
-		payload:           l.payload,
-		verifyCallback:    l.verifyCallback,
-		HandshakeStrategy: l.handshakeStrategy,
-		MaxPacketSize:     l.maxPacketSize,
-	}, nil
+	return Server(c, l.config), nil
 }
 
-// Listen creates a TLS listener accepting connections on the
-// given network address using net.Listen.
-func Listen(network, laddr string, key noise.DHKey, payload []*Field, verifyCallback VerifyCallbackFunc, handshakeStrategy int, maxPacketSize uint16) (net.Listener, error) {
+// NewListener creates a Listener which accepts connections from an inner
+// Listener and wraps each connection with Server.
+// The config cannot be nil.
+func NewListener(inner net.Listener, config *Config) net.Listener {
+	return &listener{
+		Listener: inner,
+		config:   config,
+	}
+}
 
+// Listen creates a NoiseSocket listener accepting connections on the
+// given network address using net.Listen.
+// The config cannot be nil.
+func Listen(network, laddr string, config *Config) (net.Listener, error) {
+	if config == nil {
+		return nil, errors.New("noisesocket: config is nil")
+	}
 	l, err := net.Listen(network, laddr)
 	if err != nil {
 		return nil, err
 	}
-	return &listener{
-		Listener:          l,
-		key:               key,
-		payload:           payload,
-		verifyCallback:    verifyCallback,
-		handshakeStrategy: handshakeStrategy,
-		maxPacketSize:     maxPacketSize,
-	}, nil
+	return NewListener(l, config), nil
 }
 
-func Dial(network, addr string, key noise.DHKey, serverKey []byte, payload []*Field, callbackFunc VerifyCallbackFunc, maxPacketSize uint16) (*Conn, error) {
+// Dial connects to the given network address using net.Dial
+// and then initiates a NoiseSocket handshake lazily, on the first Read or Write.
+// The config cannot be nil.
+func Dial(network, addr string, config *Config) (*Conn, error) {
+	if config == nil {
+		return nil, errors.New("noisesocket: config is nil")
+	}
 	rawConn, err := new(net.Dialer).Dial(network, addr)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Conn{
-		conn:           rawConn,
-		myKeys:         key,
-		PeerKey:        serverKey,
-		isClient:       true,
-		padding:        128,
-		payload:        payload,
-		verifyCallback: callbackFunc,
-		MaxPacketSize:  maxPacketSize,
-	}, nil
+	return Client(rawConn, config), nil
+}
+
+// DialContext connects to the given network address using net.Dialer.DialContext
+// and runs the NoiseSocket handshake with the provided context.
+//
+// The provided Context must be non-nil. If the context expires before
+// the connection and the handshake are complete, an error is returned.
+// Once successfully connected, any expiration of the context will not
+// affect the connection.
+// The config cannot be nil.
+func DialContext(ctx context.Context, network, addr string, config *Config) (*Conn, error) {
+	if config == nil {
+		return nil, errors.New("noisesocket: config is nil")
+	}
+	rawConn, err := new(net.Dialer).DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := Client(rawConn, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
 }
@@ -69,39 +69,41 @@ func (b *packet) Read(p []byte) (n int, err error) {
 	return
 }
 
-func (b *packet) AddPadding(padding uint16, maxPacketSize uint16) {
+// AddPadding appends a padding field as policy asks and returns its size, header included.
+// Nothing is added if the policy declines or the packet has no room left.
+func (b *packet) AddPadding(policy PaddingPolicy, maxPacketSize uint16) int {
 	if maxPacketSize == 0 {
 		maxPacketSize = MaxPayloadSize
 	}
 	rawDataLen := len(b.data)
 
 	payloadSize := rawDataLen + msgHeaderSize /*zero padding*/ + macSize - uint16Size /*packet header*/
-
 	if payloadSize > int(maxPacketSize) {
-		panic("no space left for padding")
+		return 0
 	}
 
-	paddingSize := uint16(0)
-	if padding > 0 {
-		paddingSize = padding - uint16(payloadSize)%padding
+	paddingSize := policy.Padding(payloadSize, int(maxPacketSize))
+	if paddingSize < 0 {
+		return 0
 	}
-
-	if payloadSize+int(paddingSize) > int(maxPacketSize) {
-		paddingSize = maxPacketSize - uint16(payloadSize)
+	if payloadSize+paddingSize > int(maxPacketSize) {
+		paddingSize = int(maxPacketSize) - payloadSize
 	}
 
-	b.resize(int(rawDataLen + msgHeaderSize + int(paddingSize)))
+	b.resize(rawDataLen + msgHeaderSize + paddingSize)
+	padding := b.data[rawDataLen+msgHeaderSize:]
+	for i := range padding {
+		padding[i] = 0
+	}
 	binary.BigEndian.PutUint16(b.data[rawDataLen:], uint16(paddingSize+uint16Size))
 	binary.BigEndian.PutUint16(b.data[rawDataLen+2:], MessageTypePadding)
+	return msgHeaderSize + paddingSize
 }
 
 func (b *packet) AddField(data []byte, msgType uint16) {
 
 	b.reserve(len(b.data) + len(data) + msgHeaderSize)
-	b.data = append(b.data, 0, 0, 0, 0)
-	binary.BigEndian.PutUint16(b.data[len(b.data)-4:], uint16(len(data)+uint16Size))
-	binary.BigEndian.PutUint16(b.data[len(b.data)-2:], msgType)
-	b.data = append(b.data, data...)
+	b.data = appendField(b.data, data, msgType)
 
 	if len(b.data) > math.MaxUint16 {
 		panic("packet is too big")
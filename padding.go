@@ -0,0 +1,90 @@
+package noisesocket
+
+import (
+	"crypto/rand"
+	"math/big"
+	"sort"
+)
+
+// A PaddingPolicy decides how much padding a transport packet carries, hiding the
+// length of the data it contains.
+// Padding gets the size of the encrypted packet payload, the padding field header and MAC
+// included, and the maximum size it can grow to. It returns the number of padding bytes
+// to add, or a negative number to send the packet without a padding field.
+// Results beyond max-size are capped.
+type PaddingPolicy interface {
+	Padding(size, max int) int
+}
+
+// PaddingFunc is an adapter to use ordinary functions as PaddingPolicy.
+type PaddingFunc func(size, max int) int
+
+// Padding calls f(size, max).
+func (f PaddingFunc) Padding(size, max int) int {
+	return f(size, max)
+}
+
+// DefaultBuckets are the packet sizes of BucketPadding if none are given.
+var DefaultBuckets = []int{256, 1024, 4096, 16384}
+
+var (
+	// NoPadding sends packets without padding.
+	NoPadding PaddingPolicy = PaddingFunc(func(int, int) int { return -1 })
+
+	// MaxPadding pads every packet to the maximum packet size.
+	MaxPadding PaddingPolicy = PaddingFunc(func(size, max int) int { return max - size })
+)
+
+// BlockPadding pads packets to the next multiple of block bytes.
+// A packet that is a multiple already gets another block.
+func BlockPadding(block int) PaddingPolicy {
+	if block <= 0 {
+		return NoPadding
+	}
+	return PaddingFunc(func(size, _ int) int {
+		return block - size%block
+	})
+}
+
+// RandomPadding adds between min and max bytes of padding, chosen with crypto/rand.
+func RandomPadding(min, max int) PaddingPolicy {
+	if max < min {
+		min, max = max, min
+	}
+	return PaddingFunc(func(int, int) int {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(max-min+1)))
+		if err != nil {
+			panic(err)
+		}
+		return min + int(n.Int64())
+	})
+}
+
+// BucketPadding pads packets to the smallest of sizes they fit in, DefaultBuckets if
+// sizes is empty. Packets larger than every bucket are padded to the maximum packet size.
+func BucketPadding(sizes ...int) PaddingPolicy {
+	if len(sizes) == 0 {
+		sizes = DefaultBuckets
+	}
+	buckets := append([]int(nil), sizes...)
+	sort.Ints(buckets)
+
+	return PaddingFunc(func(size, max int) int {
+		for _, b := range buckets {
+			if b >= size {
+				return b - size
+			}
+		}
+		return max - size
+	})
+}
+
+// Stats counts the transport packets of a connection.
+type Stats struct {
+	PacketsSent     uint64 // transport packets written
+	PacketsReceived uint64 // transport packets read
+	BytesSent       uint64 // payload bytes of the packets written, padding and MACs included
+	BytesReceived   uint64 // payload bytes of the packets read, padding and MACs included
+	PaddingSent     uint64 // padding bytes written, field headers included
+	PaddingReceived uint64 // padding bytes read, field headers included
+}
@@ -0,0 +1,173 @@
+package noisesocket
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/flynn/noise"
+	"github.com/pkg/errors"
+)
+
+// knownPatterns are the handshake patterns ParseProtocolName knows by name
+var knownPatterns = []noise.HandshakePattern{
+	noise.HandshakeN, noise.HandshakeK, noise.HandshakeX,
+	noise.HandshakeNN, noise.HandshakeKN, noise.HandshakeNK, noise.HandshakeKK,
+	noise.HandshakeNX, noise.HandshakeKX, noise.HandshakeXN, noise.HandshakeIN,
+	noise.HandshakeXK, noise.HandshakeIK, noise.HandshakeXX, noise.HandshakeIX,
+}
+
+// ParseProtocolName builds the config of a Noise protocol from its name,
+// such as Noise_XX_25519_ChaChaPoly_BLAKE2s. The pattern may carry either the fallback
+// modifier or a single psk modifier, e.g. Noise_XXfallback_448_AESGCM_SHA512.
+// Fallback patterns with pre-shared keys are not supported.
+// The protocol does not need to be registered.
+func ParseProtocolName(name string) (*HandshakeConfig, error) {
+	parts := strings.Split(name, "_")
+	if len(parts) != 5 || parts[0] != "Noise" {
+		return nil, errors.New("invalid protocol name " + name)
+	}
+
+	p, err := parsePattern(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var dh noise.DHFunc
+	for _, d := range dhFuncs {
+		if d.DHName() == parts[2] {
+			dh = d
+		}
+	}
+	if dh == nil {
+		return nil, errors.New("unsupported DH function " + parts[2])
+	}
+
+	var cipher noise.CipherFunc
+	for _, c := range ciphers {
+		if c.CipherName() == parts[3] {
+			cipher = c
+		}
+	}
+	if cipher == nil {
+		return nil, errors.New("unsupported cipher " + parts[3])
+	}
+
+	var hash noise.HashFunc
+	for _, h := range hashes {
+		if h.HashName() == parts[4] {
+			hash = h
+		}
+	}
+	if hash == nil {
+		return nil, errors.New("unsupported hash " + parts[4])
+	}
+
+	cfg, err := newHandshakeConfig(p.HandshakePattern, parts[1], dh, cipher, hash)
+	if err != nil {
+		return nil, err
+	}
+	cfg.UseRemoteStatic = p.UseRemoteKey
+	cfg.UseLocalStatic = p.UseLocalKey
+	cfg.PSK = p.PSK
+	cfg.PSKPlacement = p.PSKPlacement
+	return cfg, nil
+}
+
+// parsePattern parses a pattern name with modifiers, such as IKpsk2 or XXfallback
+func parsePattern(name string) (PatternConfig, error) {
+	var res PatternConfig
+
+	i := 0
+	for i < len(name) && name[i] >= 'A' && name[i] <= 'Z' {
+		i++
+	}
+	for _, p := range knownPatterns {
+		if p.Name == name[:i] {
+			res.HandshakePattern = p
+		}
+	}
+	if res.Name == "" {
+		return res, errors.New("unsupported handshake pattern " + name[:i])
+	}
+
+	if i < len(name) {
+		for _, modifier := range strings.Split(name[i:], "+") {
+			switch {
+			case modifier == "fallback":
+				if strings.Contains(name[i:], "psk") {
+					return res, errors.New("psk modifiers are not supported with fallback")
+				}
+				pattern, err := fallbackPattern(res.HandshakePattern)
+				if err != nil {
+					return res, err
+				}
+				res.HandshakePattern = pattern
+			case strings.HasPrefix(modifier, "psk"):
+				placement, err := strconv.Atoi(modifier[3:])
+				if err != nil || placement < 0 || placement > len(res.Messages) {
+					return res, errors.New("invalid psk modifier " + modifier)
+				}
+				if res.PSK {
+					return res, errors.New("multiple psk modifiers are not supported")
+				}
+				res.PSK = true
+				res.PSKPlacement = placement
+			default:
+				return res, errors.New("unsupported pattern modifier " + modifier)
+			}
+		}
+	}
+
+	for _, m := range res.ResponderPreMessages {
+		if m == noise.MessagePatternS {
+			res.UseRemoteKey = true
+		}
+	}
+	for _, m := range res.InitiatorPreMessages {
+		if m == noise.MessagePatternS {
+			res.UseLocalKey = true
+			res.LocalKeyKnown = true
+		}
+	}
+	for i := 0; i < len(res.Messages); i += 2 {
+		for _, m := range res.Messages[i] {
+			if m == noise.MessagePatternS {
+				res.UseLocalKey = true
+			}
+		}
+	}
+	return res, nil
+}
+
+// fallbackPattern applies the fallback modifier. The initiator's first message becomes
+// a pre-message of the responder, who then initiates the rest of the pattern
+func fallbackPattern(p noise.HandshakePattern) (noise.HandshakePattern, error) {
+	if len(p.Messages) < 2 {
+		return p, errors.New("fallback modifier needs an interactive pattern, got " + p.Name)
+	}
+	for _, m := range p.Messages[0] {
+		if m != noise.MessagePatternE && m != noise.MessagePatternS {
+			return p, errors.New("fallback modifier needs a first message without DH tokens, got " + p.Name)
+		}
+	}
+
+	res := noise.HandshakePattern{
+		Name:                 p.Name + "fallback",
+		InitiatorPreMessages: p.ResponderPreMessages,
+		ResponderPreMessages: append(append([]noise.MessagePattern(nil), p.InitiatorPreMessages...), p.Messages[0]...),
+	}
+	for _, msg := range p.Messages[1:] {
+		swapped := make([]noise.MessagePattern, len(msg))
+		for i, m := range msg {
+			switch m {
+			case noise.MessagePatternDHES:
+				m = noise.MessagePatternDHSE
+			case noise.MessagePatternDHSE:
+				m = noise.MessagePatternDHES
+			}
+			swapped[i] = m
+		}
+		res.Messages = append(res.Messages, swapped)
+	}
+	return res, nil
+}
@@ -0,0 +1,67 @@
+package noisesocket
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProtocolName(t *testing.T) {
+
+	configs := defaultRegistry.Protocols()
+	for _, fallback := range defaultRegistry.fallbacks {
+		configs = append(configs, fallback)
+	}
+
+	for _, registered := range configs {
+		cfg, err := ParseProtocolName(string(registered.Name))
+		assert.NoError(t, err)
+		assert.Equal(t, registered.Name, cfg.Name)
+		assert.Equal(t, registered.NameKey, cfg.NameKey)
+		assert.Equal(t, registered.Pattern, cfg.Pattern)
+		assert.Equal(t, registered.SuiteName(), cfg.SuiteName())
+		assert.Equal(t, registered.UseRemoteStatic, cfg.UseRemoteStatic)
+		assert.Equal(t, registered.UseLocalStatic, cfg.UseLocalStatic)
+		assert.Equal(t, registered.PSK, cfg.PSK)
+		assert.Equal(t, registered.PSKPlacement, cfg.PSKPlacement)
+	}
+
+	cfg, err := ParseProtocolName("Noise_XXfallback_25519_ChaChaPoly_BLAKE2s")
+	assert.NoError(t, err)
+	assert.Equal(t, HandshakeXXfallback, cfg.Pattern)
+
+	// parsed patterns give back the name they were parsed from
+	for _, name := range []string{"XX", "IKpsk2", "XXfallback", "NNpsk0", "KN"} {
+		p, err := parsePattern(name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, name, p.FullName())
+	}
+
+	cfg, err = ParseProtocolName("Noise_KN_25519_AESGCM_SHA256")
+	assert.NoError(t, err)
+	assert.True(t, cfg.UseLocalStatic)
+	assert.False(t, cfg.UseRemoteStatic)
+
+	tests := []struct {
+		name, err string
+	}{
+		{"Noise_XX_25519_ChaChaPoly", "invalid protocol name"},
+		{"Noise_ZZ_25519_ChaChaPoly_BLAKE2s", "handshake pattern ZZ"},
+		{"Noise_XXhfs_25519_ChaChaPoly_BLAKE2s", "pattern modifier hfs"},
+		{"Noise_XXpsk4_25519_ChaChaPoly_BLAKE2s", "psk modifier psk4"},
+		{"Noise_XXpsk0+psk3_25519_ChaChaPoly_BLAKE2s", "multiple psk"},
+		{"Noise_XXfallback+psk0_448_AESGCM_SHA512", "not supported with fallback"},
+		{"Noise_XXpsk0+fallback_448_AESGCM_SHA512", "not supported with fallback"},
+		{"Noise_NKfallback_25519_ChaChaPoly_BLAKE2s", "without DH tokens"},
+		{"Noise_Nfallback_25519_ChaChaPoly_BLAKE2s", "interactive"},
+		{"Noise_XX_P256_ChaChaPoly_BLAKE2s", "DH function P256"},
+		{"Noise_XX_25519_DES_BLAKE2s", "cipher DES"},
+		{"Noise_XX_25519_ChaChaPoly_MD5", "hash MD5"},
+	}
+	for _, test := range tests {
+		_, err := ParseProtocolName(test.name)
+		if assert.Error(t, err, test.name) {
+			assert.Contains(t, err.Error(), test.err)
+		}
+	}
+}
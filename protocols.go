@@ -1,14 +1,14 @@
 package noisesocket
 
 import (
-	"math"
+	"fmt"
 
 	"github.com/flynn/noise"
 )
 
 //supported primitives
 
-var dhFuncs = []noise.DHFunc{noise.DH25519}
+var dhFuncs = []noise.DHFunc{DH25519MLKEM768, noise.DH25519, DH448}
 var ciphers = []noise.CipherFunc{noise.CipherAESGCM, noise.CipherChaChaPoly}
 var hashes = []noise.HashFunc{noise.HashSHA256, noise.HashBLAKE2b, noise.HashSHA512, noise.HashBLAKE2s}
 
@@ -21,73 +21,127 @@ type HandshakeConfig struct {
 	NameLength      byte
 	NameKey         uint64
 	UseRemoteStatic bool
+	UseLocalStatic  bool
+	PSK             bool
+	PSKPlacement    int
+	optIn           bool // offered only if Config.CipherSuites names the suite
+}
+
+// SuiteName returns the DH, cipher and hash part of the protocol name, e.g. 25519_AESGCM_SHA256
+func (c *HandshakeConfig) SuiteName() string {
+	return c.DH.DHName() + "_" + c.Cipher.CipherName() + "_" + c.Hash.HashName()
+}
+
+// PatternName returns the pattern name including modifiers, e.g. XXpsk3
+func (c *HandshakeConfig) PatternName() string {
+	return PatternConfig{HandshakePattern: c.Pattern, PSK: c.PSK, PSKPlacement: c.PSKPlacement}.FullName()
+}
+
+// psk returns key if the protocol is psk-modified, nil otherwise
+func (c *HandshakeConfig) psk(key []byte) []byte {
+	if !c.PSK {
+		return nil
+	}
+	return key
+}
+
+// CanWrite reports whether the payload of the message msgIndex is encrypted,
+// taking the psk modifier into account
+func (c *HandshakeConfig) CanWrite(msgIndex int) bool {
+	if c.PSK && (c.PSKPlacement == 0 || c.PSKPlacement-1 <= msgIndex) {
+		return true
+	}
+	return CanWrite(c.Pattern, msgIndex)
+}
+
+// responderStatic reports whether the responder needs its static key for the pattern
+func (c *HandshakeConfig) responderStatic() bool {
+	for _, m := range c.Pattern.ResponderPreMessages {
+		if m == noise.MessagePatternS {
+			return true
+		}
+	}
+	for i := 1; i < len(c.Pattern.Messages); i += 2 {
+		for _, m := range c.Pattern.Messages[i] {
+			if m == noise.MessagePatternS {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 type PatternConfig struct {
 	noise.HandshakePattern
-	UseRemoteKey bool
+	UseRemoteKey  bool // initiator needs the responder's static key in advance
+	UseLocalKey   bool // initiator uses its own static key
+	LocalKeyKnown bool // responder needs the initiator's static key in advance
+	PSK           bool // pattern is psk-modified
+	PSKPlacement  int  // position of the psk token, see noise.Config.PresharedKeyPlacement
 }
 
-// Go does not allow slices as keys, so we use siphash for map key
-var handshakeConfigs map[uint64]*HandshakeConfig
+// FullName returns the pattern name including the psk modifier, e.g. XXpsk3
+func (p PatternConfig) FullName() string {
+	if p.PSK {
+		return fmt.Sprintf("%spsk%d", p.Name, p.PSKPlacement)
+	}
+	return p.Name
+}
+
+// patternConfigs are the built-in patterns, in the order clients offer them
 var patternConfigs = []PatternConfig{{
 	HandshakePattern: noise.HandshakeXX,
+	UseLocalKey:      true,
+}, {
+	HandshakePattern: noise.HandshakeIK,
+	UseRemoteKey:     true,
+	UseLocalKey:      true,
+}, {
+	HandshakePattern: noise.HandshakeNN,
+}, {
+	HandshakePattern: noise.HandshakeNK,
+	UseRemoteKey:     true,
+}, {
+	HandshakePattern: noise.HandshakeKK,
+	UseRemoteKey:     true,
+	UseLocalKey:      true,
+	LocalKeyKnown:    true,
+}, {
+	HandshakePattern: noise.HandshakeXX,
+	UseLocalKey:      true,
+	PSK:              true,
+	PSKPlacement:     3,
 }, {
 	HandshakePattern: noise.HandshakeIK,
 	UseRemoteKey:     true,
+	UseLocalKey:      true,
+	PSK:              true,
+	PSKPlacement:     2,
+}, {
+	HandshakePattern: noise.HandshakeNN,
+	PSK:              true,
+	PSKPlacement:     0,
 }}
 
-var protoPriorities = []string{noise.HandshakeIK.Name, noise.HandshakeXX.Name}
-
-// preffered order of ciphersuites for each pattern
-var protoCipherPriorities = make(map[string][]uint64)
-
-//a separate prologue for each pattern. The count of entries in cipherSuitePriorities is equal to the amount of entries,
-// used to form the corresponding prologue
-var prologues = make(map[string][]byte)
-
-func init() {
-	handshakeConfigs = make(map[uint64]*HandshakeConfig)
-
-	for _, pattern := range patternConfigs {
-
-		prologues[pattern.Name] = make([]byte, 0, 512)
-		protoCipherPriorities[pattern.Name] = make([]uint64, 0, 8)
-		for _, dh := range dhFuncs {
-			for _, c := range ciphers {
-				for _, h := range hashes {
-
-					name := []byte("Noise_" + pattern.Name + "_" + dh.DHName() + "_" + c.CipherName() + "_" + h.HashName())
-
-					if len(name) > math.MaxUint8 {
-						panic("message type name length exceeds 255 bytes")
-					}
-
-					nameKey := HashKey(name)
-
-					if _, exists := handshakeConfigs[nameKey]; exists {
-						panic("duplicate name hash!")
-					}
-
-					handshakeConfigs[nameKey] = &HandshakeConfig{
-						Name:            name,
-						NameLength:      byte(len(name)),
-						Pattern:         pattern.HandshakePattern,
-						DH:              dh,
-						Cipher:          c,
-						Hash:            h,
-						NameKey:         nameKey,
-						UseRemoteStatic: pattern.UseRemoteKey,
-					}
-					protoCipherPriorities[pattern.Name] = append(protoCipherPriorities[pattern.Name], nameKey)
-					prologues[pattern.Name] = append(prologues[pattern.Name], handshakeConfigs[nameKey].NameLength)
-					prologues[pattern.Name] = append(prologues[pattern.Name], name...)
-				}
-			}
-		}
+// HandshakeXXfallback is the Noise Pipes fallback pattern. When an IK attempt fails,
+// the responder becomes the initiator of XXfallback, reusing the ephemeral key from the IK message.
+var HandshakeXXfallback = noise.HandshakePattern{
+	Name:                 "XXfallback",
+	ResponderPreMessages: []noise.MessagePattern{noise.MessagePatternE},
+	Messages: [][]noise.MessagePattern{
+		{noise.MessagePatternE, noise.MessagePatternDHEE, noise.MessagePatternS, noise.MessagePatternDHSE},
+		{noise.MessagePatternS, noise.MessagePatternDHES},
+	},
+}
 
-		if len(protoCipherPriorities[pattern.Name]) > math.MaxUint8 {
-			panic("too many message types for a single pattern")
-		}
-	}
+// protoPriorities is the order servers prefer the built-in patterns in
+var protoPriorities = []string{
+	noise.HandshakeKK.Name,
+	noise.HandshakeIK.Name + "psk2",
+	noise.HandshakeIK.Name,
+	noise.HandshakeNK.Name,
+	noise.HandshakeXX.Name + "psk3",
+	noise.HandshakeXX.Name,
+	noise.HandshakeNN.Name + "psk0",
+	noise.HandshakeNN.Name,
 }
@@ -0,0 +1,289 @@
+package noisesocket
+
+import (
+	"math"
+
+	"github.com/flynn/noise"
+	"github.com/pkg/errors"
+)
+
+// A Registry holds the protocols a connection can negotiate.
+// Clients offer patterns in registration order, servers choose by pattern priority.
+// After a Registry has been passed to a Config it must not be modified.
+type Registry struct {
+	configs    map[uint64]*HandshakeConfig // protocols by name hash
+	patterns   []PatternConfig             // patterns in the order they are offered
+	suites     map[string][]uint64         // protocols of each pattern in preferred order
+	priorities []string                    // patterns in the order servers prefer them
+	fallbacks  map[uint64]*HandshakeConfig // XXfallback protocols by IK protocol
+	dhs        []noise.DHFunc              // DH functions of the registered protocols
+}
+
+// defaultRegistry is used by connections whose Config has no Registry
+var defaultRegistry = NewDefaultRegistry()
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		configs:   make(map[uint64]*HandshakeConfig),
+		suites:    make(map[string][]uint64),
+		fallbacks: make(map[uint64]*HandshakeConfig),
+	}
+}
+
+// NewDefaultRegistry returns a registry with the built-in protocols,
+// every pattern of patternConfigs combined with every DH, cipher and hash function.
+// Servers accept the hybrid suites, clients offer them only if Config.CipherSuites
+// names them, each offer carries an ML-KEM key of more than 1KB.
+// Applications may add or remove protocols without affecting other registries.
+func NewDefaultRegistry() *Registry {
+	r := NewRegistry()
+	for _, pattern := range patternConfigs {
+		if err := r.RegisterPattern(pattern, dhFuncs, ciphers, hashes); err != nil {
+			panic(err)
+		}
+	}
+	for _, cfg := range r.configs {
+		cfg.optIn = cfg.kem() != nil
+	}
+	if err := r.SetPatternPriority(protoPriorities...); err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// RegisterPattern registers pattern with every combination of dhs, ciphers and hashes,
+// in that order of preference.
+func (r *Registry) RegisterPattern(pattern PatternConfig, dhs []noise.DHFunc, ciphers []noise.CipherFunc, hashes []noise.HashFunc) error {
+	for _, dh := range dhs {
+		for _, c := range ciphers {
+			for _, h := range hashes {
+				if _, err := r.RegisterProtocol(pattern, dh, c, h); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// RegisterProtocol registers a single protocol. It is preferred less than the protocols
+// of the same pattern registered before it. A new pattern gets the lowest server priority.
+// IK protocols are answered with XXfallback if the responder cannot read them. Clients with
+// PeerKey accept the fallback only if the server presents that key or VerifyCallback accepts it.
+// Only interactive patterns of 2 or 3 messages are supported.
+func (r *Registry) RegisterProtocol(pattern PatternConfig, dh noise.DHFunc, cipher noise.CipherFunc, hash noise.HashFunc) (*HandshakeConfig, error) {
+	patternName := pattern.FullName()
+	if n := len(pattern.Messages); n < 2 || n > 3 {
+		return nil, errors.Errorf("pattern %s has %d messages, only 2 or 3 are supported", patternName, n)
+	}
+	cfg, err := newHandshakeConfig(pattern.HandshakePattern, patternName, dh, cipher, hash)
+	if err != nil {
+		return nil, err
+	}
+	cfg.UseRemoteStatic = pattern.UseRemoteKey
+	cfg.UseLocalStatic = pattern.UseLocalKey
+	cfg.PSK = pattern.PSK
+	cfg.PSKPlacement = pattern.PSKPlacement
+
+	if _, exists := r.configs[cfg.NameKey]; exists {
+		return nil, errors.New("duplicate protocol " + string(cfg.Name))
+	}
+	if len(r.suites[patternName]) == math.MaxUint8 {
+		return nil, errors.New("too many protocols for pattern " + patternName)
+	}
+
+	var fallback *HandshakeConfig
+	if patternName == noise.HandshakeIK.Name && cfg.kem() == nil { //the KEM secret is lost with the IK message
+		if fallback, err = newHandshakeConfig(HandshakeXXfallback, HandshakeXXfallback.Name, dh, cipher, hash); err != nil {
+			return nil, err
+		}
+		fallback.UseLocalStatic = true
+	}
+
+	if _, ok := r.suites[patternName]; !ok {
+		r.patterns = append(r.patterns, pattern)
+		r.priorities = append(r.priorities, patternName)
+	}
+	r.configs[cfg.NameKey] = cfg
+	r.suites[patternName] = append(r.suites[patternName], cfg.NameKey)
+	if fallback != nil {
+		r.fallbacks[cfg.NameKey] = fallback
+	}
+	if r.dh(dh.DHName()) == nil {
+		r.dhs = append(r.dhs, dh)
+	}
+	return cfg, nil
+}
+
+func newHandshakeConfig(pattern noise.HandshakePattern, patternName string, dh noise.DHFunc, cipher noise.CipherFunc, hash noise.HashFunc) (*HandshakeConfig, error) {
+	name := []byte("Noise_" + patternName + "_" + dh.DHName() + "_" + cipher.CipherName() + "_" + hash.HashName())
+	if len(name) > math.MaxUint8 {
+		return nil, errors.New("protocol name length exceeds 255 bytes")
+	}
+	return &HandshakeConfig{
+		Name:       name,
+		NameLength: byte(len(name)),
+		NameKey:    HashKey(name),
+		Pattern:    pattern,
+		DH:         dh,
+		Cipher:     cipher,
+		Hash:       hash,
+	}, nil
+}
+
+// Unregister removes the protocol with the full Noise name, such as
+// Noise_XX_25519_AESGCM_SHA256. It reports whether the protocol was registered.
+func (r *Registry) Unregister(name string) bool {
+	return r.UnregisterFunc(func(cfg *HandshakeConfig) bool {
+		return string(cfg.Name) == name
+	}) > 0
+}
+
+// UnregisterFunc removes every protocol for which match returns true,
+// for instance all protocols of a DH function. It returns the number of removed protocols.
+// Patterns left without protocols are removed as well.
+func (r *Registry) UnregisterFunc(match func(cfg *HandshakeConfig) bool) int {
+	removed := 0
+	patterns := r.patterns[:0]
+	for _, pattern := range r.patterns {
+		patternName := pattern.FullName()
+		suites := r.suites[patternName][:0]
+		for _, nameKey := range r.suites[patternName] {
+			if match(r.configs[nameKey]) {
+				delete(r.configs, nameKey)
+				delete(r.fallbacks, nameKey)
+				removed++
+				continue
+			}
+			suites = append(suites, nameKey)
+		}
+		if len(suites) == 0 {
+			delete(r.suites, patternName)
+			r.removePriority(patternName)
+			continue
+		}
+		r.suites[patternName] = suites
+		patterns = append(patterns, pattern)
+	}
+	r.patterns = patterns
+	return removed
+}
+
+func (r *Registry) removePriority(patternName string) {
+	for i, name := range r.priorities {
+		if name == patternName {
+			r.priorities = append(r.priorities[:i], r.priorities[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetPatternPriority makes servers prefer the patterns in the order given,
+// by their full names such as IKpsk2. Patterns not listed keep their relative order after them.
+func (r *Registry) SetPatternPriority(patternNames ...string) error {
+	priorities := make([]string, 0, len(r.priorities))
+	for _, name := range patternNames {
+		if _, ok := r.suites[name]; !ok {
+			return errors.New("pattern " + name + " is not registered")
+		}
+		for _, p := range priorities {
+			if p == name {
+				return errors.New("duplicate pattern " + name)
+			}
+		}
+		priorities = append(priorities, name)
+	}
+l:
+	for _, name := range r.priorities {
+		for _, p := range patternNames {
+			if p == name {
+				continue l
+			}
+		}
+		priorities = append(priorities, name)
+	}
+	r.priorities = priorities
+	return nil
+}
+
+// restrict returns a registry with the protocols of r whose full pattern names are in patterns
+// and whose suite names are in suites, preferred in the order given. Empty lists allow everything
+func (r *Registry) restrict(patterns []string, suites []string) *Registry {
+	res := NewRegistry()
+	res.fallbacks = r.fallbacks
+	res.dhs = r.dhs
+
+	allowed := r.patterns
+	if len(patterns) > 0 {
+		allowed = nil
+		for _, name := range patterns {
+			for _, p := range r.patterns {
+				if p.FullName() == name {
+					allowed = append(allowed, p)
+				}
+			}
+		}
+	}
+
+	for _, p := range allowed {
+		patternName := p.FullName()
+		var keys []uint64
+		if len(suites) == 0 {
+			keys = append(keys, r.suites[patternName]...)
+		}
+		for _, suite := range suites {
+			for _, nameKey := range r.suites[patternName] {
+				if r.configs[nameKey].SuiteName() == suite {
+					keys = append(keys, nameKey)
+				}
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		for _, nameKey := range keys {
+			cfg := r.configs[nameKey]
+			if cfg.optIn && len(suites) > 0 { //named explicitly
+				named := *cfg
+				named.optIn = false
+				cfg = &named
+			}
+			res.configs[nameKey] = cfg
+		}
+		res.patterns = append(res.patterns, p)
+		res.suites[patternName] = keys
+	}
+
+	priorities := r.priorities
+	if len(patterns) > 0 {
+		priorities = patterns
+	}
+	for _, name := range priorities {
+		if _, ok := res.suites[name]; ok {
+			res.priorities = append(res.priorities, name)
+		}
+	}
+	return res
+}
+
+// Protocols returns the registered protocols in the order they are offered.
+func (r *Registry) Protocols() []*HandshakeConfig {
+	var configs []*HandshakeConfig
+	for _, pattern := range r.patterns {
+		for _, nameKey := range r.suites[pattern.FullName()] {
+			configs = append(configs, r.configs[nameKey])
+		}
+	}
+	return configs
+}
+
+// dh returns the registered DH function with the name, nil if there is none
+func (r *Registry) dh(name string) noise.DHFunc {
+	for _, dh := range r.dhs {
+		if dh.DHName() == name {
+			return dh
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package noisesocket
+
+import (
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+
+	xx := PatternConfig{HandshakePattern: noise.HandshakeXX, UseLocalKey: true}
+
+	r := NewRegistry()
+	cfg, err := r.RegisterProtocol(xx, noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	assert.NoError(t, err)
+	assert.Equal(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s", string(cfg.Name))
+
+	_, err = r.RegisterProtocol(xx, noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	assert.Error(t, err)
+
+	long := xx
+	long.Name = strings.Repeat("X", 250)
+	_, err = r.RegisterProtocol(long, noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	assert.Error(t, err)
+
+	// one-way patterns and patterns of more than 3 messages cannot be negotiated
+	oneWay := PatternConfig{HandshakePattern: noise.HandshakeN}
+	_, err = r.RegisterProtocol(oneWay, noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	assert.Error(t, err)
+
+	four := xx
+	four.Name = "XXX"
+	four.Messages = append(append([][]noise.MessagePattern(nil), xx.Messages...), []noise.MessagePattern{noise.MessagePatternDHEE})
+	_, err = r.RegisterProtocol(four, noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	assert.Error(t, err)
+
+	assert.Error(t, r.SetPatternPriority("IK"))
+	assert.Len(t, r.Protocols(), 1)
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	// both sides use the custom registry, the default one is not affected
+	client, server := connPair(&Config{StaticKey: ki, Registry: r}, &Config{StaticKey: ks, Registry: r})
+
+	go func() {
+		client.Write([]byte("hello"))
+	}()
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(server, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), buf)
+	assert.Equal(t, "Noise_XX_25519_ChaChaPoly_BLAKE2s", server.ConnectionState().Protocol)
+	client.Close()
+	server.Close()
+
+	assert.True(t, r.Unregister("Noise_XX_25519_ChaChaPoly_BLAKE2s"))
+	assert.False(t, r.Unregister("Noise_XX_25519_ChaChaPoly_BLAKE2s"))
+	assert.Empty(t, r.Protocols())
+	assert.Empty(t, r.priorities)
+
+	d := NewDefaultRegistry()
+	assert.Equal(t, len(defaultRegistry.Protocols()), len(d.Protocols()))
+	removed := d.UnregisterFunc(func(cfg *HandshakeConfig) bool {
+		return cfg.DH.DHName() == "448"
+	})
+	assert.Equal(t, len(patternConfigs)*len(ciphers)*len(hashes), removed)
+	assert.Equal(t, len(defaultRegistry.Protocols())-removed, len(d.Protocols()))
+
+	assert.NoError(t, d.SetPatternPriority("XX", "NN"))
+	assert.Equal(t, []string{"XX", "NN", "KK", "IKpsk2", "IK", "NK", "XXpsk3", "NNpsk0"}, d.priorities)
+}
+
+func TestRestrictedSuites(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	constrained := &Config{StaticKey: ki, PeerKey: ks.Public, Patterns: []string{"IK"}, CipherSuites: []string{"25519_AESGCM_SHA256"}}
+	assert.Len(t, constrained.registry().Protocols(), 1)
+
+	tests := []struct {
+		client, server *Config
+		protocol       string
+	}{
+		{
+			constrained,
+			&Config{StaticKey: ks},
+			"Noise_IK_25519_AESGCM_SHA256",
+		},
+		{
+			&Config{StaticKey: ki, PeerKey: ks.Public},
+			&Config{StaticKey: ks, CipherSuites: []string{"25519_ChaChaPoly_SHA512", "25519_AESGCM_SHA256"}},
+			"Noise_IK_25519_ChaChaPoly_SHA512",
+		},
+		{
+			&Config{StaticKey: ki, PeerKey: ks.Public},
+			&Config{StaticKey: ks, Patterns: []string{"XX", "IK"}},
+			"Noise_XX_25519_AESGCM_SHA256",
+		},
+	}
+
+	for _, test := range tests {
+		client, server := connPair(test.client, test.server)
+
+		go func() {
+			client.Write([]byte("hello"))
+		}()
+
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(server, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, test.protocol, server.ConnectionState().Protocol)
+		assert.Equal(t, test.protocol, client.ConnectionState().Protocol)
+
+		client.Close()
+		server.Close()
+	}
+
+	// no common suite
+	client, server := connPair(
+		&Config{StaticKey: ki, CipherSuites: []string{"25519_ChaChaPoly_BLAKE2b"}},
+		&Config{StaticKey: ks, CipherSuites: []string{"25519_AESGCM_SHA256"}},
+	)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Handshake()
+	}()
+	assert.Error(t, client.Handshake())
+	assert.Error(t, <-errs)
+}
@@ -55,7 +55,12 @@ func main() {
 		MaxIdleConnsPerHost: 1,
 		DisableKeepAlives:   true,
 		DialTLS: func(network, addr string) (net.Conn, error) {
-			conn, err := noisesocket.Dial(network, addr, clientKeys, nil, payload, nil, 0)
+			conn, err := noisesocket.Dial(network, addr, &noisesocket.Config{
+				StaticKey:   clientKeys,
+				Payload:     payload,
+				KeepAlive:   5 * time.Second,
+				IdleTimeout: 15 * time.Second,
+			})
 			if err != nil {
 				fmt.Println("Dial", err)
 			}
@@ -70,7 +70,12 @@ func startNoiseSocketServer() {
 		},
 	}
 
-	l, err := noisesocket.Listen("tcp", ":12888", serverKeys, payload, nil, -1, 0)
+	l, err := noisesocket.Listen("tcp", ":12888", &noisesocket.Config{
+		StaticKey:   serverKeys,
+		Payload:     payload,
+		KeepAlive:   5 * time.Second,
+		IdleTimeout: 15 * time.Second,
+	})
 	if err != nil {
 		fmt.Println("Error listening:", err)
 		os.Exit(1)
@@ -22,7 +22,9 @@ func main() {
 		Private: priv1,
 	}
 
-	conn, err := noisesocket.Dial("tcp", "127.0.0.1:10000", clientKeys, nil, nil, nil, 0)
+	conn, err := noisesocket.Dial("tcp", "127.0.0.1:10000", &noisesocket.Config{
+		StaticKey: clientKeys,
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -11,7 +11,8 @@ import (
 
 	"io/ioutil"
 
-	"reflect"
+	"encoding/json"
+	"net"
 
 	"crypto/rand"
 
@@ -21,13 +22,14 @@ import (
 	"github.com/julienschmidt/httprouter"
 	"golang.org/x/crypto/acme/autocert"
 	"gopkg.in/noisesocket.v0"
+	"gopkg.in/noisesocket.v0/noisehttp"
 )
 
 func main() {
 
-	go startNoiseSocketServer(13242, -1)
-	go startNoiseSocketServer(13243, -2)
-	go startNoiseSocketServer(13244, 0)
+	go startNoiseSocketServer(13242, noisesocket.ServerPreference)
+	go startNoiseSocketServer(13243, noisesocket.RandomSelection)
+	go startNoiseSocketServer(13244, noisesocket.ClientPreference)
 
 	startHttpServer()
 }
@@ -47,7 +49,7 @@ func Index(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
 	w.Write(page)
 }
 
-func startNoiseSocketServer(port, strategy int) {
+func startNoiseSocketServer(port int, selector noisesocket.SuiteSelector) {
 
 	server := &http.Server{
 		ReadTimeout:  10 * time.Second,
@@ -62,35 +64,37 @@ func startNoiseSocketServer(port, strategy int) {
 
 	serverKeys := noise.DH25519.GenerateKeypair(rand.Reader)
 
-	l, err := noisesocket.Listen("tcp", fmt.Sprintf(":%d", port), serverKeys, nil, nil, strategy, 0)
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		fmt.Println("Error listening:", err)
 		os.Exit(1)
 	}
 
 	fmt.Println("Noise http server is listening on port", port)
-	if err := server.Serve(l); err != nil {
+	if err := noisehttp.ServeNoise(server, l, &noisesocket.Config{
+		StaticKey:     serverKeys,
+		SuiteSelector: selector,
+		KeepAlive:     5 * time.Second,
+		IdleTimeout:   15 * time.Second,
+	}); err != nil {
 		panic(err)
 	}
 }
 
-func Status(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+func Status(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 
-	//get underlying connection via reflection
-	val := reflect.ValueOf(w)
-	val = reflect.Indirect(val)
-
-	// w is a "http.response" struct from which we get the 'conn' field
-	val = val.FieldByName("conn")
-	val = reflect.Indirect(val)
-
-	// which is a http.conn from which we get the 'rwc' field
-	val = val.FieldByName("rwc").Elem().Elem()
-
-	infoLen := val.FieldByName("connectionInfo").Len()
-	info := val.FieldByName("connectionInfo").Slice(0, infoLen)
+	peer, ok := noisehttp.PeerFromContext(r.Context())
+	if !ok {
+		http.Error(w, "not a noise socket connection", http.StatusInternalServerError)
+		return
+	}
 
-	w.Write(info.Bytes())
+	info, err := json.MarshalIndent(peer.State, " ", "	")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(info)
 }
 
 func TlsStatus(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
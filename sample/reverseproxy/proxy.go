@@ -7,6 +7,7 @@ import (
 
 	"log"
 
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
 
@@ -14,6 +15,8 @@ import (
 
 	"encoding/base64"
 
+	"time"
+
 	"github.com/flynn/noise"
 	"github.com/namsral/flag"
 	"github.com/oxtoacart/bpool"
@@ -42,18 +45,22 @@ func startProxy(backendUrlString, listen string) {
 	backendUrl, _ := url.Parse(backendUrlString)
 	reverseProxy := httputil.NewSingleHostReverseProxy(backendUrl)
 
+	// backend connections are reused, the keepalive pings drop the ones gone stale
 	transport := &proxyTransport{
 		Transport: http.Transport{
-			DisableKeepAlives: true,
+			MaxIdleConnsPerHost: 4,
 		},
 	}
 
 	transport.DialTLS = func(network, addr string) (net.Conn, error) {
 		clientKeys := noise.DH25519.GenerateKeypair(rand.Reader)
-		conn, err := noisesocket.Dial(network, addr, clientKeys, serverPub, nil, serverCallback, 0)
-		transport.conn = conn
-		return conn, err
-
+		return noisesocket.Dial(network, addr, &noisesocket.Config{
+			StaticKey:      clientKeys,
+			PeerKey:        serverPub,
+			VerifyCallback: serverCallback,
+			KeepAlive:      5 * time.Second,
+			IdleTimeout:    15 * time.Second,
+		})
 	}
 
 	reverseProxy.Transport = transport
@@ -64,16 +71,24 @@ func startProxy(backendUrlString, listen string) {
 
 type proxyTransport struct {
 	http.Transport
-	conn *noisesocket.Conn
 }
 
-//add headers with info from proxy
+//add headers with info from the backend connection that served the request
 
 func (p *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var conn *noisesocket.Conn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn, _ = info.Conn.(*noisesocket.Conn)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
 	resp, err := p.Transport.RoundTrip(req)
-	if err == nil {
-		resp.Header.Add("X-HANDSHAKE-HASH", base64.StdEncoding.EncodeToString(p.conn.ChannelBinding()))
-		resp.Header.Add("X-PEER-KEY", base64.StdEncoding.EncodeToString(serverPub))
+	if err == nil && conn != nil {
+		resp.Header.Add("X-HANDSHAKE-HASH", base64.StdEncoding.EncodeToString(conn.ChannelBinding()))
+		resp.Header.Add("X-PEER-KEY", base64.StdEncoding.EncodeToString(conn.ConnectionState().PeerStatic))
+		resp.Header.Add("X-RTT", conn.RTT().String())
 	}
 
 	return resp, err
@@ -68,7 +68,12 @@ func makeTransport(instanceKey noise.DHKey, serverPub []byte, payload []*noiseso
 	return &http.Transport{
 		MaxIdleConnsPerHost: 10,
 		DialTLS: func(network, addr string) (net.Conn, error) {
-			conn, err := noisesocket.Dial(network, addr, instanceKey, serverPub, payload, callbackFunc, 0)
+			conn, err := noisesocket.Dial(network, addr, &noisesocket.Config{
+				StaticKey:      instanceKey,
+				PeerKey:        serverPub,
+				Payload:        payload,
+				VerifyCallback: callbackFunc,
+			})
 			if err != nil {
 				fmt.Println("Dial", err)
 			}
@@ -41,7 +41,11 @@ func startNoiseSocketServer(serverKeys noise.DHKey, payload []*noisesocket.Field
 		w.Write(buf)
 	})
 
-	l, err := noisesocket.Listen("tcp", ":12888", serverKeys, payload, verifier, -1)
+	l, err := noisesocket.Listen("tcp", ":12888", &noisesocket.Config{
+		StaticKey:      serverKeys,
+		Payload:        payload,
+		VerifyCallback: verifier,
+	})
 	if err != nil {
 		fmt.Println("Error listening:", err)
 		os.Exit(1)
@@ -0,0 +1,63 @@
+package noisesocket
+
+import (
+	"crypto/rand"
+	"math/big"
+	"net"
+	"sort"
+)
+
+// A SuiteSelector chooses which of the client's offers a server answers.
+// Select gets the offers of protocols the server supports and the client address.
+// It returns the offers to try, most preferred first. The server answers the first
+// one it can read and fails the handshake if there is none.
+type SuiteSelector interface {
+	Select(offers []*HandshakeMessage, remote net.Addr) []*HandshakeMessage
+}
+
+// SuiteSelectorFunc is an adapter to use ordinary functions as SuiteSelector.
+type SuiteSelectorFunc func(offers []*HandshakeMessage, remote net.Addr) []*HandshakeMessage
+
+// Select calls f(offers, remote).
+func (f SuiteSelectorFunc) Select(offers []*HandshakeMessage, remote net.Addr) []*HandshakeMessage {
+	return f(offers, remote)
+}
+
+var (
+	// ServerPreference selects offers in the order of the server's registry. It is the default.
+	ServerPreference SuiteSelector = SuiteSelectorFunc(serverPreference)
+
+	// ClientPreference selects offers in the order the client sent them.
+	ClientPreference SuiteSelector = SuiteSelectorFunc(clientPreference)
+
+	// RandomSelection selects offers in a random order from crypto/rand.
+	RandomSelection SuiteSelector = SuiteSelectorFunc(randomSelection)
+)
+
+func serverPreference(offers []*HandshakeMessage, _ net.Addr) []*HandshakeMessage {
+	res := append([]*HandshakeMessage(nil), offers...)
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Priority < res[j].Priority
+	})
+	return res
+}
+
+func clientPreference(offers []*HandshakeMessage, _ net.Addr) []*HandshakeMessage {
+	res := append([]*HandshakeMessage(nil), offers...)
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Index < res[j].Index
+	})
+	return res
+}
+
+func randomSelection(offers []*HandshakeMessage, _ net.Addr) []*HandshakeMessage {
+	res := append([]*HandshakeMessage(nil), offers...)
+	for i := len(res) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			panic(err)
+		}
+		res[i], res[j.Int64()] = res[j.Int64()], res[i]
+	}
+	return res
+}
@@ -0,0 +1,123 @@
+package noisesocket
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/flynn/noise"
+	"github.com/stretchr/testify/assert"
+)
+
+// indexSelector selects the offer sent at index i
+func indexSelector(i byte) SuiteSelector {
+	return SuiteSelectorFunc(func(offers []*HandshakeMessage, _ net.Addr) []*HandshakeMessage {
+		for _, m := range offers {
+			if m.Index == i {
+				return []*HandshakeMessage{m}
+			}
+		}
+		return nil
+	})
+}
+
+func TestSuiteSelector(t *testing.T) {
+
+	ki := noise.DH25519.GenerateKeypair(rand.Reader)
+	ks := noise.DH25519.GenerateKeypair(rand.Reader)
+
+	var remote net.Addr
+	custom := SuiteSelectorFunc(func(offers []*HandshakeMessage, addr net.Addr) []*HandshakeMessage {
+		remote = addr
+		for _, m := range offers {
+			if string(m.Config.Name) == "Noise_IK_25519_AESGCM_SHA256" {
+				return []*HandshakeMessage{m}
+			}
+		}
+		return nil
+	})
+
+	tests := []struct {
+		selector SuiteSelector
+		protocol string
+	}{
+		{ClientPreference, "Noise_XX_25519_AESGCM_SHA256"},
+		{custom, "Noise_IK_25519_AESGCM_SHA256"},
+		{RandomSelection, ""},
+	}
+
+	for _, test := range tests {
+		client, server := connPair(&Config{StaticKey: ki, PeerKey: ks.Public}, &Config{StaticKey: ks, SuiteSelector: test.selector})
+
+		go func() {
+			client.Write([]byte("hello"))
+		}()
+
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(server, buf)
+		assert.NoError(t, err)
+		if test.protocol != "" {
+			assert.Equal(t, test.protocol, server.ConnectionState().Protocol)
+		}
+		assert.Equal(t, server.ConnectionState().Protocol, client.ConnectionState().Protocol)
+
+		client.Close()
+		server.Close()
+	}
+	assert.NotNil(t, remote)
+
+	// a failed IK offer is answered with XXfallback only if no later offer can be read
+	stale := noise.DH25519.GenerateKeypair(rand.Reader)
+	verify := func([]byte, []*Field) error { return nil }
+	client, server := connPair(&Config{StaticKey: ki, PeerKey: stale.Public, VerifyCallback: verify, Patterns: []string{"IK", "XX"}},
+		&Config{StaticKey: ks, SuiteSelector: ClientPreference})
+	go func() {
+		client.Write([]byte("hello"))
+	}()
+	_, err := io.ReadFull(server, make([]byte, 5))
+	assert.NoError(t, err)
+	assert.Equal(t, "Noise_XX_25519_AESGCM_SHA256", server.ConnectionState().Protocol)
+	client.Close()
+	server.Close()
+
+	// an offer the server has no key for does not stop it from reading the next one
+	mixed := &Config{
+		StaticKey:    DH448.GenerateKeypair(rand.Reader),
+		StaticKeys:   map[string]noise.DHKey{"25519": ki},
+		CipherSuites: []string{"448_AESGCM_SHA256", "25519_AESGCM_SHA256"},
+	}
+	for _, selector := range []SuiteSelector{ClientPreference, RandomSelection} {
+		client, server := connPair(mixed, &Config{StaticKey: ks, SuiteSelector: selector})
+
+		go func() {
+			client.Write([]byte("hello"))
+		}()
+
+		buf := make([]byte, 5)
+		_, err := io.ReadFull(server, buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "Noise_XX_25519_AESGCM_SHA256", server.ConnectionState().Protocol)
+		assert.Equal(t, ki.Public, server.ConnectionState().PeerStatic)
+
+		client.Close()
+		server.Close()
+	}
+
+	// selecting nothing fails the handshake
+	client, server = connPair(&Config{StaticKey: ki}, &Config{StaticKey: ks, SuiteSelector: custom})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Handshake()
+	}()
+	assert.Error(t, client.Handshake())
+	assert.Error(t, <-errs)
+}
+
+func TestSelectorOrder(t *testing.T) {
+	offers := []*HandshakeMessage{{Index: 0, Priority: 2}, {Index: 1, Priority: 0}, {Index: 2, Priority: 1}}
+
+	assert.Equal(t, []*HandshakeMessage{offers[1], offers[2], offers[0]}, ServerPreference.Select(offers, nil))
+	assert.Equal(t, offers, ClientPreference.Select(offers, nil))
+	assert.ElementsMatch(t, offers, RandomSelection.Select(offers, nil))
+}
@@ -27,6 +27,9 @@ type Vector struct {
 	InitialMessage   string     `json:"initial_message"`
 	Protocols        []string   `json:"protocols"`
 	Sessions         []*Session `json:"sessions"`
+	// static key of a responder that does not match init_remote_static, so IK falls back to XXfallback
+	RespFallbackStatic string     `json:"resp_fallback_static,omitempty"`
+	FallbackSessions   []*Session `json:"fallback_sessions,omitempty"`
 }
 
 type Session struct {
@@ -52,12 +55,13 @@ type VectorField struct {
 
 func TestGenerateVectors(t *testing.T) {
 
-	is, rs, ie, re := make([]byte, 0, 32), make([]byte, 0, 32), make([]byte, 0, 32), make([]byte, 0, 32)
+	is, rs, ie, re, fs := make([]byte, 0, 32), make([]byte, 0, 32), make([]byte, 0, 32), make([]byte, 0, 32), make([]byte, 0, 32)
 	for i := byte(0); i < 32; i++ {
 		ie = append(ie, i%2)
 		re = append(re, i%3)
 		is = append(is, i%4)
 		rs = append(rs, i%5)
+		fs = append(fs, i%6)
 	}
 
 	ki := noise.DH25519.GenerateKeypair(bytes.NewBuffer(is))
@@ -82,13 +86,10 @@ func TestGenerateVectors(t *testing.T) {
 	assert.NoError(t, err)
 	vec.Prologue = hex.EncodeToString(prologue)
 
-	for _, pattern := range []noise.HandshakePattern{noise.HandshakeXX, noise.HandshakeIK} {
-
-		for _, csp := range protoCipherPriorities[pattern.Name] {
-			cfg := handshakeConfigs[csp]
-			vec.Protocols = append(vec.Protocols, fmt.Sprintf("%s", cfg.Name))
-
-		}
+	r := defaultRegistry
+	configs := r.offeredConfigs(r.offeredPatterns(true, kr.Public, false, false), r.staticKeys(ki, nil), kr.Public)
+	for _, cfg := range configs {
+		vec.Protocols = append(vec.Protocols, fmt.Sprintf("%s", cfg.Name))
 	}
 
 	pkt = InitializePacket()
@@ -99,7 +100,10 @@ func TestGenerateVectors(t *testing.T) {
 
 	//sequetially choose sub-message from the first message
 	for i, istate := range iStates {
-		parsedPayload, rstate, cfg, msgIndex, err := ParseHandshake(kr, ihm, i, re)
+		if configs[i].kem() != nil { //hybrid suites use a random ML-KEM key and are not reproducible
+			continue
+		}
+		parsedPayload, rstate, cfg, msgIndex, err := ParseHandshake(&ResponderKeys{Static: kr}, ihm, indexSelector(byte(i)), nil, re)
 		assert.NoError(t, err)
 
 		sess := &Session{
@@ -180,11 +184,11 @@ func TestGenerateVectors(t *testing.T) {
 
 					pkti := InitializePacket()
 					pkti.AddField(di, MessageTypeData)
-					pkti.AddPadding(10, 0)
+					pkti.AddPadding(BlockPadding(10), 0)
 
 					pktr := InitializePacket()
 					pktr.AddField(dr, MessageTypeData)
-					pktr.AddPadding(10, 0)
+					pktr.AddPadding(BlockPadding(10), 0)
 
 					msg = &Message{
 						Payload: hex.EncodeToString(pkti.data[2:]),
@@ -245,6 +249,108 @@ func TestGenerateVectors(t *testing.T) {
 
 		}
 	}
+
+	//IK messages sent to a responder whose static key has changed are answered with XXfallback
+	kf := noise.DH25519.GenerateKeypair(bytes.NewBuffer(fs))
+	ke := noise.DH25519.GenerateKeypair(bytes.NewBuffer(ie))
+	vec.RespFallbackStatic = hex.EncodeToString(fs)
+
+	for i := range iStates {
+		if configs[i].kem() != nil {
+			continue
+		}
+		_, rstate, cfg, msgIndex, err := ParseHandshake(&ResponderKeys{Static: kf}, ihm, indexSelector(byte(i)), nil, re)
+		assert.NoError(t, err)
+		if cfg.Pattern.Name != HandshakeXXfallback.Name {
+			continue
+		}
+
+		sess := &Session{
+			Index:   msgIndex,
+			Pattern: cfg.Pattern.Name,
+			Dh:      cfg.DH.DHName(),
+			Cipher:  cfg.Cipher.CipherName(),
+			Hash:    cfg.Hash.HashName(),
+		}
+		vec.FallbackSessions = append(vec.FallbackSessions, sess)
+
+		//the responder cannot read the IK payload
+		sess.Messages = append(sess.Messages, &Message{})
+
+		istate := newFallbackState(cfg, ki, ke, prologue)
+
+		//responder initiates XXfallback
+		pkt = InitializePacket()
+		pkt.resize(len(pkt.data) + 2)
+		pkt.data[len(pkt.data)-2] = msgIndex
+		pkt.data[len(pkt.data)-1] = 1
+
+		payload := new(packet)
+		payload.AddField(serverCert, MessageTypeCustomCert)
+
+		var hsm []byte
+		var cs1i, cs2i, cs1r, cs2r *noise.CipherState
+		hsm, _, _ = rstate.WriteMessage(nil, payload.data)
+		pkt.data = append(pkt.data, hsm...)
+		binary.BigEndian.PutUint16(pkt.data, uint16(len(pkt.data)-2))
+
+		parsedPayload, _, _, err := istate.ReadMessage(nil, hsm)
+		assert.NoError(t, err)
+		fields, err := parseMessageFields(parsedPayload)
+		assert.NoError(t, err)
+		sess.Messages = append(sess.Messages, &Message{
+			Payload: hex.EncodeToString(parsedPayload),
+			Fields:  fieldsToVector(fields),
+			Packet:  hex.EncodeToString(pkt.data),
+		})
+
+		//initiator finishes the handshake
+		pkt = InitializePacket()
+		payload = new(packet)
+		payload.AddField(clientCert, MessageTypeCustomCert)
+
+		hsm, cs1i, cs2i = istate.WriteMessage(nil, payload.data)
+		pkt.data = append(pkt.data, hsm...)
+		binary.BigEndian.PutUint16(pkt.data, uint16(len(pkt.data)-2))
+
+		parsedPayload, cs1r, cs2r, err = rstate.ReadMessage(nil, hsm)
+		assert.NoError(t, err)
+		fields, err = parseMessageFields(parsedPayload)
+		assert.NoError(t, err)
+		sess.Messages = append(sess.Messages, &Message{
+			Payload: hex.EncodeToString(parsedPayload),
+			Fields:  fieldsToVector(fields),
+			Packet:  hex.EncodeToString(pkt.data),
+		})
+		sess.HandshakeHash = hex.EncodeToString(istate.ChannelBinding())
+
+		for j := 0; j < 2; j++ {
+			for _, cs := range [][2]*noise.CipherState{{cs1i, cs1r}, {cs2r, cs2i}} {
+				d := make([]byte, 11+2*j)
+				rand.Read(d)
+
+				pkti := InitializePacket()
+				pkti.AddField(d, MessageTypeData)
+				pkti.AddPadding(BlockPadding(10), 0)
+
+				msg := &Message{
+					Payload: hex.EncodeToString(pkti.data[2:]),
+				}
+				pkti.data = cs[0].Encrypt(pkti.data[:2], nil, pkti.data[2:])
+				binary.BigEndian.PutUint16(pkti.data, uint16(len(pkti.data)-2))
+				msg.Packet = hex.EncodeToString(pkti.data)
+
+				dec, err := cs[1].Decrypt(nil, nil, pkti.data[2:])
+				assert.NoError(t, err)
+				fields, err := parseMessageFields(dec)
+				assert.NoError(t, err)
+				msg.Fields = fieldsToVector(fields)
+
+				sess.Messages = append(sess.Messages, msg)
+			}
+		}
+	}
+
 	v, _ := json.Marshal(vec)
 	fmt.Printf("%s\n", v)
 
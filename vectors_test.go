@@ -30,7 +30,7 @@ func TestVectors(t *testing.T) {
 	initialMessage := Unpacket(t, mustHex(vector.InitialMessage))
 	for i, session := range vector.Sessions {
 
-		parsedPayload, rstate, cfg, msgIndex, err := ParseHandshake(kr, initialMessage, i, re)
+		parsedPayload, rstate, cfg, msgIndex, err := ParseHandshake(&ResponderKeys{Static: kr}, initialMessage, indexSelector(byte(i)), nil, re)
 		assert.NoError(t, err)
 		assert.Equal(t, msgIndex, byte(i))
 
@@ -148,6 +148,80 @@ func TestVectors(t *testing.T) {
 			}
 		}
 	}
+
+	//IK messages answered with XXfallback by a responder with a different static key
+	kf := noise.DH25519.GenerateKeypair(bytes.NewBuffer(mustHex(vector.RespFallbackStatic)))
+	ke := noise.DH25519.GenerateKeypair(bytes.NewBuffer(mustHex(vector.InitEphemeral)))
+	assert.NotEmpty(t, vector.FallbackSessions)
+
+	for _, session := range vector.FallbackSessions {
+
+		_, rstate, cfg, msgIndex, err := ParseHandshake(&ResponderKeys{Static: kf}, initialMessage, indexSelector(session.Index), nil, re)
+		assert.NoError(t, err)
+		assert.Equal(t, session.Index, msgIndex)
+		assert.Equal(t, HandshakeXXfallback.Name, cfg.Pattern.Name)
+		assert.Equal(t, session.Pattern, cfg.Pattern.Name)
+
+		istate := newFallbackState(cfg, ki, ke, mustHex(vector.Prologue))
+
+		//responder initiates XXfallback
+		pkt := InitializePacket()
+		pkt.data = append(pkt.data, msgIndex, 1)
+		payload := new(packet)
+		for _, f := range session.Messages[1].Fields {
+			payload.AddField(mustHex(f.Data), f.Type)
+		}
+		hsm, _, _ := rstate.WriteMessage(nil, payload.data)
+		pkt.data = append(pkt.data, hsm...)
+		binary.BigEndian.PutUint16(pkt.data, uint16(len(pkt.data)-2))
+		assert.Equal(t, mustHex(session.Messages[1].Packet), pkt.data)
+
+		rawPacket := Unpacket(t, pkt.data)
+		assert.Equal(t, byte(1), rawPacket[1])
+		parsedPayload, _, _, err := istate.ReadMessage(nil, rawPacket[2:])
+		assert.NoError(t, err)
+		ValidateMessage(t, session.Messages[1], parsedPayload)
+
+		//initiator finishes the handshake
+		pkt = InitializePacket()
+		payload = new(packet)
+		for _, f := range session.Messages[2].Fields {
+			payload.AddField(mustHex(f.Data), f.Type)
+		}
+		hsm, cs1i, cs2i := istate.WriteMessage(nil, payload.data)
+		pkt.data = append(pkt.data, hsm...)
+		binary.BigEndian.PutUint16(pkt.data, uint16(len(pkt.data)-2))
+		assert.Equal(t, mustHex(session.Messages[2].Packet), pkt.data)
+
+		parsedPayload, cs1r, cs2r, err := rstate.ReadMessage(nil, Unpacket(t, pkt.data))
+		assert.NoError(t, err)
+		ValidateMessage(t, session.Messages[2], parsedPayload)
+
+		hh := mustHex(session.HandshakeHash)
+		assert.Equal(t, hh, istate.ChannelBinding())
+		assert.Equal(t, hh, rstate.ChannelBinding())
+
+		//transport messages alternate initiator to responder and back
+		for mi := 3; mi < len(session.Messages); mi++ {
+			enc, dec := cs1i, cs1r
+			if mi%2 == 0 {
+				enc, dec = cs2r, cs2i
+			}
+			pkti := InitializePacket()
+			for _, f := range session.Messages[mi].Fields {
+				pkti.AddField(mustHex(f.Data), f.Type)
+			}
+			assert.Equal(t, mustHex(session.Messages[mi].Payload), pkti.data[2:])
+
+			pkti.data = enc.Encrypt(pkti.data[:2], nil, pkti.data[2:])
+			binary.BigEndian.PutUint16(pkti.data, uint16(len(pkti.data)-2))
+			assert.Equal(t, mustHex(session.Messages[mi].Packet), pkti.data)
+
+			data, err := dec.Decrypt(nil, nil, Unpacket(t, pkti.data))
+			assert.NoError(t, err)
+			ValidateMessage(t, session.Messages[mi], data)
+		}
+	}
 }
 
 func Unpacket(t *testing.T, packet []byte) []byte {